@@ -0,0 +1,178 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	globalAllow cidrList
+	globalDeny  cidrList
+	viewerUsers map[string]string
+	authRealm   string
+)
+
+type accessPolicy struct {
+	allow cidrList
+	deny  cidrList
+}
+
+func newAccessPolicy(allow, deny []string) (*accessPolicy, error) {
+	policy := new(accessPolicy)
+
+	var err error
+	policy.allow, err = parseCIDRList(strings.Join(allow, ","))
+	if err != nil {
+		return nil, err
+	}
+	policy.deny, err = parseCIDRList(strings.Join(deny, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// loadUsers reads user:password lines, where the password is either
+// plain text or a htpasswd style {SHA} hash.
+func loadUsers(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid users line: %s", line)
+		}
+		users[kv[0]] = kv[1]
+	}
+
+	return users, scanner.Err()
+}
+
+func checkPassword(stored, password string) bool {
+	if strings.HasPrefix(stored, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// authenticate returns the user name for valid basic auth credentials.
+func authenticate(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	stored, found := viewerUsers[user]
+	if !found || !checkPassword(stored, password) {
+		return "", false
+	}
+
+	return user, true
+}
+
+// checkAccess applies the policy and asks for credentials if the client
+// needs to log in.
+func (policy *accessPolicy) checkAccess(w http.ResponseWriter, r *http.Request) (string, int) {
+	user, status := policy.decide(r)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	}
+
+	return user, status
+}
+
+// decide applies the deny and allow lists to the client address.
+// Allowed clients skip authentication, others need to log in if users
+// are configured or are rejected if an allow list exists.
+func (policy *accessPolicy) decide(r *http.Request) (string, int) {
+	ip := hostIP(clientAddress(r))
+
+	if globalDeny.Contains(ip) || policy.deny.Contains(ip) {
+		return "", http.StatusForbidden
+	}
+
+	if globalAllow.Contains(ip) || policy.allow.Contains(ip) {
+		return "", http.StatusOK
+	}
+
+	if viewerUsers != nil {
+		user, ok := authenticate(r)
+		if !ok {
+			return "", http.StatusUnauthorized
+		}
+		return user, http.StatusOK
+	}
+
+	if len(globalAllow) > 0 || len(policy.allow) > 0 {
+		return "", http.StatusForbidden
+	}
+
+	return "", http.StatusOK
+}
+
+// restricted applies the global allow, deny and user lists to pages
+// that reveal sources and viewers.
+func restricted(handler http.Handler) http.Handler {
+	policy := new(accessPolicy)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, status := policy.checkAccess(w, r)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// visibleSources returns the sources the client may view, so pages
+// listing all sources leave out the others.
+func visibleSources(r *http.Request) []*PubSub {
+	sources := make([]*PubSub, 0, len(proxySources))
+	for _, pubSub := range proxySources {
+		if _, status := pubSub.access.decide(r); status == http.StatusOK {
+			sources = append(sources, pubSub)
+		}
+	}
+
+	return sources
+}
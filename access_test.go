@@ -0,0 +1,68 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVisibleSources(t *testing.T) {
+	open := newTestSource(t, "/open", &testSource{start: make(chan struct{})})
+	private := newTestSource(t, "/private", &testSource{start: make(chan struct{})})
+	var err error
+	private.access, err = newAccessPolicy([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := proxySources
+	proxySources = []*PubSub{open, private}
+	defer func() { proxySources = saved }()
+
+	tests := []struct {
+		addr    string
+		sources []string
+	}{
+		{"192.0.2.1:1234", []string{"/open", "/private"}},
+		{"198.51.100.1:1234", []string{"/open"}},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.RemoteAddr = test.addr
+
+		report := collectStatus(r)
+		var paths []string
+		for _, source := range report.Sources {
+			paths = append(paths, source.Path)
+		}
+		if len(paths) != len(test.sources) {
+			t.Errorf("%s: sources %v, want %v", test.addr, paths, test.sources)
+			continue
+		}
+		for i := range paths {
+			if paths[i] != test.sources[i] {
+				t.Errorf("%s: sources %v, want %v", test.addr, paths, test.sources)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Session termination reasons reported in the access log.
+const (
+	reasonClientClosed = "client-closed"
+	reasonSourceEnded  = "source-ended"
+	reasonSourceFailed = "source-failed"
+	reasonWriteFailed  = "write-failed"
+	reasonBadRequest   = "bad-request"
+	reasonDenied       = "denied"
+	reasonOverLimit    = "over-limit"
+	reasonEvicted      = "evicted"
+	reasonLagging      = "lagging"
+	reasonClosed       = "closed"
+)
+
+// statusClientClosed is logged for clients that left before a response
+// was sent, like nginx does.
+const statusClientClosed = 499
+
+var accessLog *AccessLog
+
+type AccessLog struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	file   *os.File
+}
+
+type accessSession struct {
+	start     time.Time
+	user      string
+	status    int
+	frames    uint64
+	skipped   uint64 // over the requested or adapted frame rate
+	throttled uint64 // over the bandwidth limits
+	bytes     int64
+	reason    string
+}
+
+type accessEntry struct {
+	Client          string    `json:"client"`
+	User            string    `json:"user,omitempty"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Query           string    `json:"query,omitempty"`
+	Proto           string    `json:"proto"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+	Status          int       `json:"status"`
+	Start           time.Time `json:"start"`
+	Duration        float64   `json:"duration"`
+	FramesSent      uint64    `json:"frames_sent"`
+	FramesSkipped   uint64    `json:"frames_skipped"`
+	FramesThrottled uint64    `json:"frames_throttled"`
+	Bytes           int64     `json:"bytes"`
+	Reason          string    `json:"reason"`
+}
+
+// countingWriter tracks the number of bytes sent to the client.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func NewAccessLog(path, format string) (*AccessLog, error) {
+	switch format {
+	case "combined", "json":
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	accessLog := new(AccessLog)
+
+	accessLog.path = path
+	accessLog.format = format
+
+	err := accessLog.Reopen()
+	if err != nil {
+		return nil, err
+	}
+
+	return accessLog, nil
+}
+
+// Reopen closes and opens the log file again, so it can be rotated.
+func (accessLog *AccessLog) Reopen() error {
+	file, err := os.OpenFile(accessLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	accessLog.mu.Lock()
+	old := accessLog.file
+	accessLog.file = file
+	accessLog.mu.Unlock()
+
+	if old != nil {
+		err = old.Close()
+		if err != nil {
+			logServer.Warn("access log close failed", "file", accessLog.path, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// ReopenOnSignal reopens the log file whenever SIGHUP is received.
+func (accessLog *AccessLog) ReopenOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := accessLog.Reopen()
+			if err != nil {
+				logServer.Error("access log reopen failed", "file", accessLog.path, "error", err)
+			} else {
+				logServer.Info("access log reopened", "file", accessLog.path)
+			}
+		}
+	}()
+}
+
+func newAccessSession() *accessSession {
+	session := new(accessSession)
+
+	session.start = time.Now()
+
+	return session
+}
+
+func clientHost(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		return client
+	}
+
+	return host
+}
+
+// logEscape escapes quotes, backslashes and bytes outside printable
+// ASCII like nginx, so client values cannot forge log fields or lines.
+func logEscape(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			b.WriteString(`\x`)
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0x0f])
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+func (accessLog *AccessLog) formatCombined(entry *accessEntry, r *http.Request) []byte {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return logEscape(s)
+	}
+
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" frames=%d skipped=%d throttled=%d duration=%.3f reason=%s\n",
+		clientHost(entry.Client), dash(entry.User),
+		entry.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		logEscape(entry.Method), logEscape(r.RequestURI), logEscape(entry.Proto), entry.Status, entry.Bytes,
+		dash(entry.Referer), dash(entry.UserAgent),
+		entry.FramesSent, entry.FramesSkipped, entry.FramesThrottled, entry.Duration, dash(entry.Reason)))
+}
+
+func (accessLog *AccessLog) Log(r *http.Request, session *accessSession) {
+	if accessLog == nil { // disabled
+		return
+	}
+
+	entry := &accessEntry{
+		Client:          clientAddress(r),
+		User:            session.user,
+		Method:          r.Method,
+		Path:            r.URL.Path,
+		Query:           r.URL.RawQuery,
+		Proto:           r.Proto,
+		UserAgent:       r.UserAgent(),
+		Referer:         r.Referer(),
+		Status:          session.status,
+		Start:           session.start,
+		Duration:        time.Since(session.start).Seconds(),
+		FramesSent:      session.frames,
+		FramesSkipped:   session.skipped,
+		FramesThrottled: session.throttled,
+		Bytes:           session.bytes,
+		Reason:          session.reason,
+	}
+
+	var line []byte
+	if accessLog.format == "json" {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			logServer.Error("access log encode failed", "error", err)
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		line = accessLog.formatCombined(entry, r)
+	}
+
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+
+	_, err := accessLog.file.Write(line)
+	if err != nil {
+		logServer.Error("access log write failed", "file", accessLog.path, "error", err)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogEscape(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"curl/8.0", "curl/8.0"},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{"a\nb\tc", `a\x0Ab\x09c`},
+		{"\x7f\xff", `\x7F\xFF`},
+	}
+
+	for _, test := range tests {
+		if out := logEscape(test.in); out != test.out {
+			t.Errorf("%q: %s, want %s", test.in, out, test.out)
+		}
+	}
+}
+
+func TestFormatCombinedEscape(t *testing.T) {
+	r := httptest.NewRequest("GET", "/cam?a=%22", nil)
+	r.RequestURI = "/cam?\"x\" 200"
+	r.Header.Set("User-Agent", "evil\" \"forged\n127.0.0.1 - - [x]")
+	entry := &accessEntry{
+		Client:    "192.0.2.1:1234",
+		Method:    r.Method,
+		Proto:     r.Proto,
+		UserAgent: r.UserAgent(),
+		Status:    200,
+		Start:     time.Now(),
+	}
+
+	line := string(new(AccessLog).formatCombined(entry, r))
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("line broken: %s", line)
+	}
+	if !strings.Contains(line, `"GET /cam?\"x\" 200 HTTP/1.1"`) {
+		t.Errorf("request not escaped: %s", line)
+	}
+	if !strings.Contains(line, `"evil\" \"forged\x0A127.0.0.1 - - [x]"`) {
+		t.Errorf("user agent not escaped: %s", line)
+	}
+}
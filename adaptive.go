@@ -0,0 +1,80 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	adaptiveMinInterval = 20 * time.Millisecond
+	adaptiveMaxInterval = 5 * time.Second
+	adaptiveHeadroom    = 1.5
+	adaptiveSpeedup     = 0.9
+	adaptiveSmoothing   = 0.25
+)
+
+var adaptiveRate bool
+
+// rateController picks the frame interval for one viewer from the time
+// it takes to write and flush frames. The interval grows right away when
+// the link is slow and shrinks gradually back to the requested rate.
+type rateController struct {
+	min      time.Duration
+	interval time.Duration
+	latency  time.Duration
+}
+
+func newRateController(min time.Duration) *rateController {
+	control := new(rateController)
+
+	control.min = min
+	control.interval = min
+
+	return control
+}
+
+func (control *rateController) Update(writeTime time.Duration) time.Duration {
+	if control.latency == 0 {
+		control.latency = writeTime
+	} else {
+		control.latency += time.Duration(adaptiveSmoothing * float64(writeTime-control.latency))
+	}
+
+	target := time.Duration(adaptiveHeadroom * float64(control.latency))
+	if target > control.interval {
+		control.interval = target
+	} else {
+		control.interval = time.Duration(adaptiveSpeedup * float64(control.interval))
+	}
+
+	if control.interval < control.min || control.interval < adaptiveMinInterval {
+		control.interval = control.min
+	}
+	if control.interval > adaptiveMaxInterval {
+		control.interval = adaptiveMaxInterval
+	}
+
+	return control.interval
+}
+
+func (control *rateController) Latency() time.Duration {
+	return control.latency
+}
@@ -0,0 +1,149 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const keepAliveRetry = 5 * time.Second
+
+// timeWindow is a daily period in minutes after midnight, local time.
+// Windows ending before they start wrap around midnight, and an end of
+// 24:00 runs to the end of the day.
+type timeWindow struct {
+	start int
+	end   int
+}
+
+const endOfDay = 24 * 60
+
+func parseClock(clock string) (int, error) {
+	if clock == "24:00" {
+		return endOfDay, nil
+	}
+
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseTimeWindow parses a window like "07:00-19:30", "00:00-24:00" for
+// the whole day.
+func parseTimeWindow(window string) (timeWindow, error) {
+	var w timeWindow
+
+	var start, end string
+	n, _ := fmt.Sscanf(window, "%5s-%5s", &start, &end)
+	if n != 2 {
+		return w, fmt.Errorf("invalid time window: %s", window)
+	}
+
+	var err error
+	w.start, err = parseClock(start)
+	if err != nil {
+		return w, err
+	}
+	w.end, err = parseClock(end)
+	if err != nil {
+		return w, err
+	}
+	if w.start == endOfDay || w.start == w.end {
+		return w, fmt.Errorf("empty time window: %s", window)
+	}
+
+	return w, nil
+}
+
+func parseTimeWindows(windows []string) ([]timeWindow, error) {
+	result := make([]timeWindow, 0, len(windows))
+	for _, window := range windows {
+		w, err := parseTimeWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+	}
+
+	return result, nil
+}
+
+func (w timeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+
+	return minute >= w.start || minute < w.end
+}
+
+// keepConnected reports whether the source should stay connected
+// without subscribers.
+func (pubSub *PubSub) keepConnected(now time.Time) bool {
+	if !pubSub.schedule.Open(now) {
+		return false
+	}
+	if pubSub.alwaysOn {
+		return true
+	}
+
+	for _, w := range pubSub.windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepAlive connects or disconnects the source as the configured
+// windows open and close, and ends viewing when the schedule closes.
+// It runs in the loop.
+func (pubSub *PubSub) keepAlive() {
+	now := time.Now()
+	if !pubSub.schedule.Open(now) {
+		pubSub.stopSubscribers()
+		pubSub.stopChunker()
+		return
+	}
+
+	if pubSub.keepConnected(now) {
+		if pubSub.pubChan != nil {
+			return
+		}
+		err := pubSub.startChunker()
+		if err != nil {
+			pubSub.publish(Event{
+				Type:    EventError,
+				Error:   err.Error(),
+				Message: "failed to start chunker",
+			})
+		}
+		return
+	}
+
+	if pubSub.pubChan != nil && len(pubSub.subscribers) == 0 {
+		pubSub.stopChunker()
+	}
+}
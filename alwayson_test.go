@@ -0,0 +1,126 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func at(t *testing.T, clock string) time.Time {
+	// 2024-01-05 is a Friday
+	now, err := time.ParseInLocation("2006-01-02 15:04", "2024-01-05 "+clock, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return now
+}
+
+func TestTimeWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		clock  string
+		open   bool
+	}{
+		{"07:00-19:30", "06:59", false},
+		{"07:00-19:30", "07:00", true},
+		{"07:00-19:30", "19:30", false},
+		{"22:00-06:00", "21:59", false},
+		{"22:00-06:00", "23:59", true},
+		{"22:00-06:00", "00:00", true},
+		{"22:00-06:00", "05:59", true},
+		{"22:00-06:00", "06:00", false},
+		{"00:00-24:00", "00:00", true},
+		{"00:00-24:00", "12:00", true},
+		{"00:00-24:00", "23:59", true},
+		{"18:00-24:00", "17:59", false},
+		{"18:00-24:00", "23:59", true},
+		{"18:00-24:00", "00:00", false},
+	}
+
+	for _, test := range tests {
+		w, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Fatalf("%s: %s", test.window, err)
+		}
+		if open := w.Contains(at(t, test.clock)); open != test.open {
+			t.Errorf("%s at %s: open %v", test.window, test.clock, open)
+		}
+	}
+}
+
+func TestTimeWindowInvalid(t *testing.T) {
+	for _, window := range []string{"24:00-06:00", "08:00-08:00", "08:00-24:01", "25:00-26:00", "8-9"} {
+		_, err := parseTimeWindow(window)
+		if err == nil {
+			t.Errorf("%s: accepted", window)
+		}
+	}
+}
+
+func TestKeepConnectedFullDay(t *testing.T) {
+	windows, err := parseTimeWindows([]string{"00:00-24:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := &PubSub{windows: windows}
+
+	for _, clock := range []string{"00:00", "12:00", "23:59"} {
+		if !pubSub.keepConnected(at(t, clock)) {
+			t.Errorf("disconnected at %s", clock)
+		}
+	}
+}
+
+func TestScheduleRanges(t *testing.T) {
+	tests := []struct {
+		spec  string
+		day   string // date in January 2024, the 5th is a Friday
+		clock string
+		open  bool
+	}{
+		{"Mon-Fri 00:00-24:00", "05", "23:59", true},
+		{"Mon-Fri 00:00-24:00", "06", "00:00", false},
+		{"Mon-Fri", "05", "23:59", true},
+		{"Mon-Fri", "06", "12:00", false},
+		{"Sat,Sun", "06", "00:00", true},
+		{"Sat,Sun", "07", "23:59", true},
+		{"Sat,Sun", "08", "00:00", false},
+		{"Fri 22:00-06:00", "05", "23:59", true},
+		{"Fri 22:00-06:00", "06", "05:59", true},
+		{"Fri 22:00-06:00", "06", "22:00", false},
+		{"Fri 22:00-24:00", "05", "23:59", true},
+		{"Fri 22:00-24:00", "06", "00:00", false},
+	}
+
+	for _, test := range tests {
+		sched, err := newSchedule([]string{test.spec}, "")
+		if err != nil {
+			t.Fatalf("%s: %s", test.spec, err)
+		}
+		now, err := time.ParseInLocation("2006-01-02 15:04", "2024-01-"+test.day+" "+test.clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if open := sched.Open(now); open != test.open {
+			t.Errorf("%s on %s at %s: open %v", test.spec, now.Weekday(), test.clock, open)
+		}
+	}
+}
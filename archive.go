@@ -0,0 +1,301 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultArchivePath = "{source}/{date}/{time}.jpg"
+	archiveCleanup     = 10 * time.Minute
+)
+
+type configArchive struct {
+	Dir       string // base directory, retention only removes files in it
+	Path      string // file template relative to Dir
+	Interval  string // save every interval, like "5m"
+	Cron      string // or at cron times, like "0 8-18 * * 1-5"
+	Retention string // remove older snapshots, like "720h"
+}
+
+// Archiver saves the current frame of a source at fixed times. Frames
+// come from the source like for any viewer, so an idle source is only
+// connected for the snapshot and disconnected after the stop delay.
+type Archiver struct {
+	pubSub    *PubSub
+	dir       string
+	path      string
+	interval  time.Duration
+	cron      *cronSpec
+	retention time.Duration
+	location  *time.Location
+	cleaned   time.Time
+	root      string           // static start of the template in dir
+	match     []*regexp.Regexp // template path components below root
+}
+
+var archivePlaceholders = map[string]string{
+	"{date}":     `\d{4}-\d{2}-\d{2}`,
+	"{time}":     `\d{6}`,
+	"{datetime}": `\d{8}-\d{6}`,
+	"{unix}":     `\d+`,
+	"{seq}":      `\d+`,
+}
+
+var placeholderRe = regexp.MustCompile(`\{[a-z]+\}`)
+
+func archiveSource(id string) string {
+	source := strings.Trim(id, "/")
+	if source == "" {
+		source = "root"
+	}
+
+	return source
+}
+
+func newArchiver(pubSub *PubSub, conf configArchive, location *time.Location) (*Archiver, error) {
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("archive directory not set")
+	}
+
+	archiver := new(Archiver)
+
+	archiver.pubSub = pubSub
+	archiver.dir = conf.Dir
+	archiver.path = conf.Path
+	if archiver.path == "" {
+		archiver.path = defaultArchivePath
+	}
+	if filepath.IsAbs(archiver.path) || strings.Contains(archiver.path, "..") {
+		return nil, fmt.Errorf("archive path must stay in the directory: %s", archiver.path)
+	}
+	archiver.location = location
+	archiver.matchTemplate()
+
+	var err error
+	switch {
+	case conf.Cron != "" && conf.Interval != "":
+		return nil, fmt.Errorf("archive needs either an interval or a cron schedule")
+	case conf.Cron != "":
+		archiver.cron, err = parseCron(conf.Cron)
+		if err != nil {
+			return nil, err
+		}
+	case conf.Interval != "":
+		archiver.interval, err = time.ParseDuration(conf.Interval)
+		if err != nil || archiver.interval < time.Second {
+			return nil, fmt.Errorf("invalid archive interval: %s", conf.Interval)
+		}
+	default:
+		return nil, fmt.Errorf("archive needs an interval or a cron schedule")
+	}
+
+	if conf.Retention != "" {
+		archiver.retention, err = time.ParseDuration(conf.Retention)
+		if err != nil || archiver.retention <= 0 {
+			return nil, fmt.Errorf("invalid archive retention: %s", conf.Retention)
+		}
+	}
+
+	return archiver, nil
+}
+
+// next returns the next save time. Intervals are aligned to the clock,
+// so every 5m saves at :00, :05 and so on.
+func (archiver *Archiver) next(now time.Time) time.Time {
+	if archiver.cron != nil {
+		return archiver.cron.Next(now.In(archiver.location))
+	}
+
+	return now.Truncate(archiver.interval).Add(archiver.interval)
+}
+
+// filename expands the path template for a frame.
+func (archiver *Archiver) filename(frame *Frame, now time.Time) string {
+	local := now.In(archiver.location)
+
+	name := strings.NewReplacer(
+		"{source}", archiveSource(archiver.pubSub.id),
+		"{date}", local.Format("2006-01-02"),
+		"{time}", local.Format("150405"),
+		"{datetime}", local.Format("20060102-150405"),
+		"{unix}", strconv.FormatInt(now.Unix(), 10),
+		"{seq}", strconv.FormatUint(frame.Seq, 10),
+	).Replace(archiver.path)
+
+	return filepath.Join(archiver.dir, filepath.FromSlash(name))
+}
+
+// save writes the frame through a temporary file so partial images are
+// never left behind.
+func (archiver *Archiver) save(frame *Frame, now time.Time) (string, error) {
+	filename := archiver.filename(frame, now)
+
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, frame.Data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return filename, os.Rename(tmp, filename)
+}
+
+// matchTemplate prepares the cleanup so it only touches paths this
+// source can produce, leaving other sources sharing the directory alone.
+func (archiver *Archiver) matchTemplate() {
+	path := strings.ReplaceAll(archiver.path, "{source}", archiveSource(archiver.pubSub.id))
+	parts := strings.Split(path, "/")
+
+	// leading components without placeholders are the same for every file
+	root := archiver.dir
+	for len(parts) > 1 && !placeholderRe.MatchString(parts[0]) {
+		root = filepath.Join(root, parts[0])
+		parts = parts[1:]
+	}
+	archiver.root = root
+
+	archiver.match = make([]*regexp.Regexp, len(parts))
+	for i, part := range parts {
+		var expr strings.Builder
+		last := 0
+		for _, loc := range placeholderRe.FindAllStringIndex(part, -1) {
+			expr.WriteString(regexp.QuoteMeta(part[last:loc[0]]))
+			if re, ok := archivePlaceholders[part[loc[0]:loc[1]]]; ok {
+				expr.WriteString(re)
+			} else {
+				expr.WriteString(regexp.QuoteMeta(part[loc[0]:loc[1]]))
+			}
+			last = loc[1]
+		}
+		expr.WriteString(regexp.QuoteMeta(part[last:]))
+		archiver.match[i] = regexp.MustCompile("^" + expr.String() + "$")
+	}
+}
+
+// matches reports whether a path below root follows the template, as
+// a complete file name or as one of its directories.
+func (archiver *Archiver) matches(path string, dir bool) bool {
+	rel, err := filepath.Rel(archiver.root, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if (dir && len(parts) >= len(archiver.match)) || (!dir && len(parts) != len(archiver.match)) {
+		return false
+	}
+	for i, part := range parts {
+		if !archiver.match[i].MatchString(part) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cleanup removes snapshots of this source older than the retention and
+// the template directories left empty.
+func (archiver *Archiver) cleanup(now time.Time) {
+	if archiver.retention == 0 || now.Sub(archiver.cleaned) < archiveCleanup {
+		return
+	}
+	archiver.cleaned = now
+
+	var dirs []string
+	removed := 0
+	limit := now.Add(-archiver.retention)
+	filepath.WalkDir(archiver.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == archiver.root {
+			return nil
+		}
+		if d.IsDir() {
+			if !archiver.matches(path, true) {
+				return fs.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		if !archiver.matches(path, false) {
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil && info.ModTime().Before(limit) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+
+	// deepest first, removing only the empty ones
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+
+	if removed > 0 {
+		logPubSub.Info("archive cleaned up", "source", archiver.pubSub.id, "removed", removed)
+	}
+}
+
+func (archiver *Archiver) run() {
+	pubSub := archiver.pubSub
+
+	for {
+		now := time.Now()
+		next := archiver.next(now)
+		if next.IsZero() {
+			logPubSub.Warn("archive schedule never matches", "source", pubSub.id)
+			return
+		}
+		time.Sleep(time.Until(next))
+
+		now = time.Now()
+		archiver.cleanup(now)
+		if !pubSub.schedule.Open(now) {
+			continue
+		}
+
+		frame, err := pubSub.Snapshot("archive:" + pubSub.id)
+		if err != nil {
+			logPubSub.Warn("archive snapshot failed", "source", pubSub.id, "error", err)
+			continue
+		}
+		filename, err := archiver.save(frame, now)
+		frame.Release()
+		if err != nil {
+			logPubSub.Warn("archive save failed", "source", pubSub.id, "error", err)
+			continue
+		}
+		logPubSub.Debug("snapshot archived", "source", pubSub.id, "file", filename)
+	}
+}
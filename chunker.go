@@ -29,6 +29,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -48,16 +49,31 @@ import (
 */
 
 type Chunker struct {
-	id       string
-	source   *url.URL
-	username string
-	password string
-	digest   bool
-	resp     *http.Response
-	boundary string
-	stop     chan struct{}
-	rate     float64
-	cancel   context.CancelFunc
+	id        string
+	source    *url.URL
+	username  string
+	password  string
+	digest    bool
+	resp      *http.Response
+	boundary  string
+	stop      chan struct{}
+	rate      float64
+	cancel    context.CancelFunc
+	started   time.Time
+	seq       uint64 // last published frame, kept across reconnects
+	quiet     bool   // probes do not publish events
+	timeout   time.Duration
+	virtual   virtualSource // produces frames instead of connecting
+	transform *Transform
+	dedup     *Dedup
+	validator *frameValidator
+
+	mu        sync.Mutex
+	state     string
+	lastFrame time.Time
+	lastError string
+	input     *rateMeter
+	jitter    *sampleWindow
 }
 
 func NewChunker(id, source, username, password string, digest bool, rate float64) (*Chunker, error) {
@@ -77,6 +93,9 @@ func NewChunker(id, source, username, password string, digest bool, rate float64
 	chunker.password = password
 	chunker.digest = digest
 	chunker.rate = rate
+	chunker.state = "idle"
+	chunker.input = newRateMeter()
+	chunker.jitter = newSampleWindow()
 
 	return chunker, nil
 }
@@ -89,8 +108,66 @@ func (chunker *Chunker) digestAuthEnabled() bool {
 	return chunker.username != "" && chunker.password != "" && chunker.digest
 }
 
+func (chunker *Chunker) publish(ev Event) {
+	if chunker.quiet {
+		return
+	}
+	ev.Source = chunker.id
+	ev.subsystem = "chunker"
+	if ev.Type == EventState {
+		chunker.setState(ev.State, ev.Error)
+	}
+	eventBus.Publish(ev)
+}
+
+func (chunker *Chunker) setState(state, lastError string) {
+	chunker.mu.Lock()
+	chunker.state = state
+	if lastError != "" {
+		chunker.lastError = lastError
+	}
+	chunker.mu.Unlock()
+}
+
+func (chunker *Chunker) frameReceived(size int) {
+	chunker.input.Mark(size)
+
+	chunker.mu.Lock()
+	chunker.lastFrame = time.Now()
+	chunker.mu.Unlock()
+}
+
+// Stats returns the connection state, time of the last frame and
+// the last upstream error.
+func (chunker *Chunker) Stats() (string, time.Time, string) {
+	chunker.mu.Lock()
+	defer chunker.mu.Unlock()
+
+	return chunker.state, chunker.lastFrame, chunker.lastError
+}
+
 func (chunker *Chunker) Connect() error {
-	fmt.Printf("chunker[%s]: connecting to %s\n", chunker.id, chunker.source)
+	err := chunker.connect()
+	if err != nil {
+		chunker.setState("failed", err.Error())
+	}
+
+	return err
+}
+
+func (chunker *Chunker) connect() error {
+	chunker.publish(Event{
+		Type:    EventState,
+		State:   "connecting",
+		URL:     chunker.source.Redacted(),
+		Message: "connecting",
+	})
+
+	if chunker.virtual != nil { // nothing to connect to
+		chunker.cancel = func() {}
+		chunker.stop = make(chan struct{})
+		return nil
+	}
 
 	req, err := http.NewRequest("GET", chunker.source.String(), nil)
 	if err != nil {
@@ -110,7 +187,7 @@ func (chunker *Chunker) Connect() error {
 		req.SetBasicAuth(chunker.username, chunker.password)
 	}
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: chunker.timeout}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -148,7 +225,7 @@ func (chunker *Chunker) Connect() error {
 func (chunker *Chunker) closeResponse(resp *http.Response) {
 	err := resp.Body.Close()
 	if err != nil {
-		fmt.Printf("chunker[%s]: body close failed: %s\n", chunker.id, err)
+		logChunker.Warn("body close failed", "source", chunker.id, "error", err)
 	}
 }
 
@@ -191,6 +268,10 @@ func getBoundary(resp *http.Response) (string, error) {
 }
 
 func (chunker *Chunker) GetHeader() http.Header {
+	if chunker.resp == nil { // never connected
+		return http.Header{}
+	}
+
 	return chunker.resp.Header
 }
 
@@ -204,7 +285,7 @@ WatchLoop:
 		case <-ticker.C:
 			framesReceived := atomic.SwapInt32(counter, 0)
 			if framesReceived == 0 {
-				fmt.Printf("chunker[%s]: frame timeout\n", chunker.id)
+				chunker.publish(Event{Type: EventTimeout, Message: "frame timeout"})
 				chunker.cancel()
 				break WatchLoop
 			}
@@ -214,18 +295,34 @@ WatchLoop:
 	}
 }
 
-func (chunker *Chunker) Start(pubChan chan []byte) {
-	fmt.Printf("chunker[%s]: started\n", chunker.id)
+func (chunker *Chunker) Start(pubChan chan *Frame) {
+	chunker.started = time.Now()
+	chunker.publish(Event{Type: EventState, State: "started", Message: "started"})
+
+	if chunker.virtual != nil {
+		chunker.virtual.run(chunker, pubChan)
+		close(pubChan)
+		chunker.publish(Event{
+			Type:     EventState,
+			State:    "stopped",
+			Message:  "stopped",
+			duration: time.Since(chunker.started),
+		})
+		return
+	}
 
 	body := chunker.resp.Body
 	defer func() {
 		err := body.Close()
 		if err != nil {
-			fmt.Printf("chunker[%s]: body close failed: %s\n", chunker.id, err)
+			logChunker.Warn("body close failed", "source", chunker.id, "error", err)
 		}
 	}()
 	defer close(pubChan)
 
+	// a restarted chunker gets a new stop channel
+	stop := chunker.stop
+
 	var failure error
 	mr := multipart.NewReader(body, chunker.boundary)
 
@@ -236,6 +333,12 @@ func (chunker *Chunker) Start(pubChan chan []byte) {
 		ticker = time.NewTicker(time.Duration(interval))
 	}
 
+	// jitter is the change between consecutive frame intervals
+	var lastReceived time.Time
+	var lastInterval time.Duration
+
+	var rejects int // consecutive invalid frames
+
 	var frameCounter int32
 	if frameTimeout > 0 {
 		go chunker.watcher(frameTimeout, &frameCounter)
@@ -253,25 +356,59 @@ ChunkLoop:
 			break ChunkLoop
 		}
 
-		data, err := ioutil.ReadAll(part)
+		frame, err := readFrame(part, part.Header.Get("Content-Length"))
 		if err != nil {
 			failure = err
 			break ChunkLoop
 		}
+		frame.Time = time.Now()
+		frame.Header = part.Header
+
+		if !lastReceived.IsZero() {
+			interval := frame.Time.Sub(lastReceived)
+			if lastInterval > 0 {
+				jitter := interval - lastInterval
+				if jitter < 0 {
+					jitter = -jitter
+				}
+				chunker.jitter.Add(jitter)
+			}
+			lastInterval = interval
+		}
+		lastReceived = frame.Time
 
 		err = part.Close()
 		if err != nil {
+			frame.Release()
 			failure = err
 			break ChunkLoop
 		}
 
-		if len(data) == 0 {
+		if len(frame.Data) == 0 {
+			frame.Release()
 			failure = errors.New("received final chunk of size 0")
 			break ChunkLoop
 		}
+		if chunker.validator != nil {
+			err = chunker.validator.Check(frame)
+			if err != nil {
+				frame.Release()
+				chunker.validator.reject()
+				rejects++
+				logChunker.Debug("invalid frame", "source", chunker.id, "error", err)
+				if rejects >= chunker.validator.maxRejects {
+					failure = fmt.Errorf("%d invalid frames: %s", rejects, err)
+					break ChunkLoop
+				}
+				continue ChunkLoop
+			}
+			rejects = 0
+		}
+		chunker.frameReceived(len(frame.Data))
 
 		select { // check for stop
-		case <-chunker.stop:
+		case <-stop:
+			frame.Release()
 			break ChunkLoop
 		default:
 		}
@@ -280,12 +417,37 @@ ChunkLoop:
 			select {
 			case <-ticker.C: // use frame
 			default: // skip frame
+				frame.Release()
 				continue ChunkLoop
 			}
 		}
 
 		firstFrame = false
-		pubChan <- data
+		// compare frames as the camera sent them, before the transform
+		if chunker.dedup != nil && chunker.dedup.Duplicate(chunker, frame) {
+			frame.Release()
+			continue ChunkLoop
+		}
+		if chunker.transform != nil {
+			out, err := chunker.transform.Apply(frame)
+			frame.Release()
+			if err != nil {
+				logChunker.Debug("transform failed", "source", chunker.id, "error", err)
+				continue ChunkLoop
+			}
+			frame = out
+		}
+		chunker.seq++
+		frame.Seq = chunker.seq
+		frame.Width, frame.Height, _ = jpegSize(frame.Data)
+
+		// the loop stops reading once it stopped the chunker
+		select {
+		case pubChan <- frame:
+		case <-stop:
+			frame.Release()
+			break ChunkLoop
+		}
 	}
 
 	if ticker != nil {
@@ -294,14 +456,28 @@ ChunkLoop:
 	chunker.cancel()
 
 	if failure != nil {
-		fmt.Printf("chunker[%s]: failed: %s\n", chunker.id, failure)
+		chunker.publish(Event{
+			Type:     EventState,
+			State:    "failed",
+			Error:    failure.Error(),
+			Message:  "failed",
+			duration: time.Since(chunker.started),
+		})
 	} else {
-		fmt.Printf("chunker[%s]: stopped\n", chunker.id)
+		chunker.publish(Event{
+			Type:     EventState,
+			State:    "stopped",
+			Message:  "stopped",
+			duration: time.Since(chunker.started),
+		})
 	}
 }
 
 func (chunker *Chunker) Stop() {
-	fmt.Printf("chunker[%s]: stopping\n", chunker.id)
+	// keep the failed state of a stream that ended on its own
+	if state, _, _ := chunker.Stats(); state != "failed" {
+		chunker.publish(Event{Type: EventState, State: "stopping", Message: "stopping"})
+	}
 	close(chunker.stop)
 }
 
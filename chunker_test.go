@@ -0,0 +1,73 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChunkerStopWhilePublishing(t *testing.T) {
+	frame := testFrame(t)
+	defer frame.Release()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		for {
+			_, err := fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n%s\r\n",
+				len(frame.Data), frame.Data)
+			if err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections() // a blocked chunker does not read
+
+	chunker, err := NewChunker("/stop", server.URL, "", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunker.quiet = true
+	err = chunker.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody reads the frames, like a loop that already stopped it
+	pubChan := make(chan *Frame)
+	done := make(chan struct{})
+	go func() {
+		chunker.Start(pubChan)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	chunker.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("chunker blocked publishing after stop")
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies cidrList
+
+type cidrList []*net.IPNet
+
+// parseCIDRList reads a comma separated list of networks, where plain
+// addresses are taken as single host networks.
+func parseCIDRList(list string) (cidrList, error) {
+	var cidrs cidrList
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", item)
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+
+	return cidrs, nil
+}
+
+func (cidrs cidrList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostIP extracts the address from host, host:port, [host]:port or
+// [host] forms, returning nil if it is not an IP address.
+func hostIP(host string) net.IP {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+
+	return net.ParseIP(host)
+}
+
+// trustedPeer reports whether the request came from a trusted proxy.
+// Unix socket peers have no address and are always local.
+func trustedPeer(remoteAddr string) bool {
+	ip := hostIP(remoteAddr)
+	if ip == nil {
+		return true
+	}
+
+	return trustedProxies.Contains(ip)
+}
+
+// parseForwarded returns the for= values of a RFC 7239 Forwarded header.
+func parseForwarded(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				hops = append(hops, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+
+	return hops
+}
+
+func headerHops(r *http.Request) []string {
+	if strings.EqualFold(clientHeader, "Forwarded") {
+		return parseForwarded(r.Header.Values("Forwarded"))
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values(clientHeader) {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// clientAddress honours the client header only from trusted proxies and
+// picks the rightmost hop that was not added by a trusted proxy.
+func clientAddress(r *http.Request) string {
+	client := r.RemoteAddr
+
+	if clientHeader == "" || !trustedPeer(client) {
+		return client
+	}
+
+	hops := headerHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hostIP(hops[i])
+		if ip == nil { // unknown or obfuscated hop
+			break
+		}
+
+		client = hops[i]
+		if !trustedProxies.Contains(ip) {
+			break
+		}
+	}
+
+	return client
+}
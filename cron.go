@@ -0,0 +1,150 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a five field cron expression: minute, hour, day of month,
+// month and day of week. Fields take *, values, ranges, lists and steps.
+type cronSpec struct {
+	minute  [60]bool
+	hour    [24]bool
+	day     [32]bool
+	month   [13]bool
+	weekday [7]bool
+	anyDay  bool
+	anyWeek bool
+}
+
+// parseCronField marks the values selected by one field.
+func parseCronField(field string, set []bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step: %s", part)
+			}
+			step = n
+			part = base
+		}
+
+		first, last := min, max
+		if part != "*" {
+			lo, hi, isRange := strings.Cut(part, "-")
+			var err error
+			first, err = strconv.Atoi(lo)
+			if err != nil {
+				return fmt.Errorf("invalid value: %s", part)
+			}
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(hi)
+				if err != nil {
+					return fmt.Errorf("invalid value: %s", part)
+				}
+			} else if step > 1 {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return fmt.Errorf("value out of range: %s", part)
+		}
+
+		for v := first; v <= last; v += step {
+			set[v] = true
+		}
+	}
+
+	return nil
+}
+
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron needs five fields: %s", spec)
+	}
+
+	cron := new(cronSpec)
+
+	var weekdays [8]bool // 7 is also Sunday
+	err := parseCronField(fields[0], cron.minute[:], 0, 59)
+	if err == nil {
+		err = parseCronField(fields[1], cron.hour[:], 0, 23)
+	}
+	if err == nil {
+		err = parseCronField(fields[2], cron.day[:], 1, 31)
+	}
+	if err == nil {
+		err = parseCronField(fields[3], cron.month[:], 1, 12)
+	}
+	if err == nil {
+		err = parseCronField(fields[4], weekdays[:], 0, 7)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cron %q: %s", spec, err)
+	}
+	copy(cron.weekday[:], weekdays[:7])
+	cron.weekday[0] = cron.weekday[0] || weekdays[7]
+	cron.anyDay = fields[2] == "*"
+	cron.anyWeek = fields[4] == "*"
+
+	return cron, nil
+}
+
+// matches follows cron in accepting either day field when both are
+// restricted.
+func (cron *cronSpec) matches(t time.Time) bool {
+	if !cron.minute[t.Minute()] || !cron.hour[t.Hour()] || !cron.month[t.Month()] {
+		return false
+	}
+
+	day := cron.day[t.Day()]
+	weekday := cron.weekday[t.Weekday()]
+	switch {
+	case cron.anyDay && cron.anyWeek:
+		return true
+	case cron.anyDay:
+		return weekday
+	case cron.anyWeek:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// Next returns the first matching minute after t, searching a year
+// ahead, or the zero time.
+func (cron *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		t = t.Add(time.Minute)
+		if cron.matches(t) {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,228 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dedupExact   = "exact"
+	dedupSimilar = "similar"
+
+	thumbWidth  = 32
+	thumbHeight = 24
+)
+
+type configDedup struct {
+	Mode        string  // exact or similar
+	Threshold   float64 // similar: mean luma difference 0-255, default 2
+	KeepAlive   float64 // minimum fps passed on for static scenes, default 1
+	StuckFrames int     // identical frames in a row that raise the alarm
+}
+
+// Dedup drops frames that repeat the last published one, while still
+// passing on KeepAlive frames per second. It runs in the chunker.
+type Dedup struct {
+	duplicates uint64
+	stuck      int32
+
+	mode        string
+	threshold   float64
+	keepAlive   time.Duration
+	stuckFrames int
+
+	lastHash      uint64
+	lastThumb     []byte
+	lastPublished time.Time
+	prevHash      uint64
+	repeats       int
+}
+
+func newDedup(conf configDedup) (*Dedup, error) {
+	dedup := new(Dedup)
+
+	switch conf.Mode {
+	case "", dedupExact:
+		dedup.mode = dedupExact
+	case dedupSimilar:
+		dedup.mode = dedupSimilar
+	default:
+		return nil, fmt.Errorf("unknown dedup mode: %s", conf.Mode)
+	}
+
+	dedup.threshold = conf.Threshold
+	if dedup.threshold <= 0 {
+		dedup.threshold = 2
+	}
+	keepAlive := conf.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 1
+	}
+	dedup.keepAlive = frameInterval(keepAlive)
+	dedup.stuckFrames = conf.StuckFrames
+
+	return dedup, nil
+}
+
+func frameHash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+
+	return h.Sum64()
+}
+
+// thumbnail returns the mean luma of a grid over the image, read from
+// the block means of baseline images and fully decoding the others.
+func thumbnail(data []byte) ([]byte, error) {
+	var src image.Image
+	step := 1
+	src, err := jpegDC(data)
+	if err != nil {
+		src, err = jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		step = 2 // sample every other pixel of the full image
+	}
+
+	b := src.Bounds()
+	ycc, _ := src.(*image.YCbCr)
+	gray, _ := src.(*image.Gray)
+	thumb := make([]byte, thumbWidth*thumbHeight)
+	for ty := 0; ty < thumbHeight; ty++ {
+		y0 := b.Min.Y + ty*b.Dy()/thumbHeight
+		y1 := b.Min.Y + (ty+1)*b.Dy()/thumbHeight
+		for tx := 0; tx < thumbWidth; tx++ {
+			x0 := b.Min.X + tx*b.Dx()/thumbWidth
+			x1 := b.Min.X + (tx+1)*b.Dx()/thumbWidth
+
+			sum, n := 0, 0
+			for y := y0; y < y1; y += step {
+				for x := x0; x < x1; x += step {
+					switch {
+					case ycc != nil:
+						sum += int(ycc.Y[ycc.YOffset(x, y)])
+					case gray != nil:
+						sum += int(gray.Pix[gray.PixOffset(x, y)])
+					default:
+						r, g, b, _ := src.At(x, y).RGBA()
+						sum += int((19595*r + 38470*g + 7471*b) >> 24)
+					}
+					n++
+				}
+			}
+			if n > 0 {
+				thumb[ty*thumbWidth+tx] = byte(sum / n)
+			}
+		}
+	}
+
+	return thumb, nil
+}
+
+func thumbDiff(a, b []byte) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 255
+	}
+
+	total := 0
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		total += d
+	}
+
+	return float64(total) / float64(len(a))
+}
+
+// Duplicate reports whether the frame should be dropped, and checks
+// for a camera repeating the same image.
+func (dedup *Dedup) Duplicate(chunker *Chunker, frame *Frame) bool {
+	hash := frameHash(frame.Data)
+
+	// identical frames in a row mean the camera is stuck
+	if hash == dedup.prevHash {
+		dedup.repeats++
+	} else {
+		dedup.repeats = 0
+	}
+	dedup.prevHash = hash
+	dedup.checkStuck(chunker)
+
+	var thumb []byte
+	duplicate := hash == dedup.lastHash
+	if !duplicate && dedup.mode == dedupSimilar {
+		var err error
+		thumb, err = thumbnail(frame.Data)
+		duplicate = err == nil && thumbDiff(thumb, dedup.lastThumb) < dedup.threshold
+	}
+
+	if duplicate && frame.Time.Sub(dedup.lastPublished) < dedup.keepAlive {
+		atomic.AddUint64(&dedup.duplicates, 1)
+		return true
+	}
+
+	dedup.lastHash = hash
+	if dedup.mode == dedupSimilar && thumb != nil {
+		dedup.lastThumb = thumb
+	}
+	dedup.lastPublished = frame.Time
+
+	return false
+}
+
+func (dedup *Dedup) checkStuck(chunker *Chunker) {
+	if dedup.stuckFrames <= 0 {
+		return
+	}
+
+	stuck := dedup.repeats+1 >= dedup.stuckFrames
+	if stuck == dedup.Stuck() {
+		return
+	}
+
+	if stuck {
+		atomic.StoreInt32(&dedup.stuck, 1)
+		chunker.publish(Event{
+			Type:    EventStuck,
+			Message: fmt.Sprintf("camera stuck, %d identical frames", dedup.repeats+1),
+		})
+	} else {
+		atomic.StoreInt32(&dedup.stuck, 0)
+		chunker.publish(Event{Type: EventStuck, Message: "camera recovered"})
+	}
+}
+
+func (dedup *Dedup) Duplicates() uint64 {
+	return atomic.LoadUint64(&dedup.duplicates)
+}
+
+func (dedup *Dedup) Stuck() bool {
+	return atomic.LoadInt32(&dedup.stuck) != 0
+}
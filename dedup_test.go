@@ -0,0 +1,155 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// encodeTest encodes a gradient with a bright square, sized so the
+// last MCUs are partial.
+func encodeTest(t testing.TB, gray bool) []byte {
+	var img image.Image
+	rgba := image.NewRGBA(image.Rect(0, 0, 100, 70))
+	for y := 0; y < 70; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{byte(2 * x), byte(3 * y), 0x80, 0xff}
+			if x >= 40 && x < 60 && y >= 20 && y < 40 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+			rgba.SetRGBA(x, y, c)
+		}
+	}
+	img = rgba
+	if gray {
+		g := image.NewGray(rgba.Bounds())
+		for y := 0; y < 70; y++ {
+			for x := 0; x < 100; x++ {
+				g.Set(x, y, rgba.At(x, y))
+			}
+		}
+		img = g
+	}
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestJPEGDC(t *testing.T) {
+	for _, gray := range []bool{false, true} {
+		data := encodeTest(t, gray)
+		dc, err := jpegDC(data)
+		if err != nil {
+			t.Fatalf("gray %v: %s", gray, err)
+		}
+		if b := dc.Bounds(); b.Dx() != 13 || b.Dy() != 9 {
+			t.Fatalf("gray %v: size %v", gray, b)
+		}
+
+		// block means of the full decode, skipping the partial blocks
+		full, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for by := 0; by < 70/8; by++ {
+			for bx := 0; bx < 100/8; bx++ {
+				sum := 0
+				for y := by * 8; y < by*8+8; y++ {
+					for x := bx * 8; x < bx*8+8; x++ {
+						switch img := full.(type) {
+						case *image.YCbCr:
+							sum += int(img.Y[img.YOffset(x, y)])
+						case *image.Gray:
+							sum += int(img.Pix[img.PixOffset(x, y)])
+						}
+					}
+				}
+				want, got := sum/64, int(dc.GrayAt(bx, by).Y)
+				if got < want-3 || got > want+3 {
+					t.Errorf("gray %v: block %d,%d mean %d, want %d", gray, bx, by, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestJPEGDCProgressive(t *testing.T) {
+	data := encodeTest(t, false)
+	i := bytes.Index(data, []byte{0xff, 0xc0})
+	data[i+1] = 0xc2
+
+	_, err := jpegDC(data)
+	if err != errDCUnsupported {
+		t.Fatalf("progressive: %v", err)
+	}
+}
+
+func TestThumbnailSimilar(t *testing.T) {
+	data := encodeTest(t, false)
+	dc, err := thumbnail(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same image at a lower quality is similar
+	img, _ := jpeg.Decode(bytes.NewReader(data))
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 60})
+	other, err := thumbnail(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := thumbDiff(dc, other); diff >= 2 {
+		t.Errorf("requality differs by %.1f", diff)
+	}
+}
+
+func BenchmarkThumbnail(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, 1280, 720))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	data := buf.Bytes()
+
+	b.Run("dc", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := thumbnail(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
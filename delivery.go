@@ -0,0 +1,140 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/* Frame delivery policies decide what happens when a subscriber is not
+   ready for the next frame:
+
+   drop:       skip the frame (default)
+   latest:     replace the waiting frame so the newest one is sent next
+   queue:      buffer up to N frames, skip new ones when full
+   disconnect: buffer up to N frames, disconnect the subscriber when full
+*/
+
+const (
+	deliveryDrop       = "drop"
+	deliveryLatest     = "latest"
+	deliveryQueue      = "queue"
+	deliveryDisconnect = "disconnect"
+
+	maxQueueSize = 1000
+)
+
+var (
+	defaultDelivery  string
+	defaultQueueSize int
+)
+
+func parseDelivery(policy string) (string, error) {
+	switch policy {
+	case "":
+		return deliveryDrop, nil
+	case deliveryDrop, deliveryLatest, deliveryQueue, deliveryDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown delivery policy: %s", policy)
+	}
+}
+
+func parseQueueSize(size string) (int, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 1 || n > maxQueueSize {
+		return 0, fmt.Errorf("invalid queue size: %s", size)
+	}
+
+	return n, nil
+}
+
+// setDelivery prepares the chunk channel for the delivery policy,
+// it needs to be called before subscribing.
+func (s *Subscriber) setDelivery(policy string, queueSize int) {
+	s.Delivery = policy
+
+	switch policy {
+	case deliveryLatest:
+		s.ChunkChannel = make(chan *Frame, 1)
+	case deliveryQueue, deliveryDisconnect:
+		s.ChunkChannel = make(chan *Frame, queueSize)
+	default:
+		s.ChunkChannel = make(chan *Frame)
+	}
+}
+
+// deliver passes on a frame reference according to the delivery policy
+// and returns false if the subscriber fell too far behind. Frames that
+// are not passed on are released here.
+func (s *Subscriber) deliver(frame *Frame) bool {
+	switch s.Delivery {
+	case deliveryLatest:
+		for { // only the loop sends, so this ends on the second try
+			select {
+			case s.ChunkChannel <- frame:
+				return true
+			default:
+			}
+
+			select {
+			case stale := <-s.ChunkChannel: // replace the stale frame
+				stale.Release()
+				s.drop()
+			default:
+			}
+		}
+
+	case deliveryDisconnect:
+		select {
+		case s.ChunkChannel <- frame:
+			return true
+		default:
+			frame.Release()
+			s.drop()
+			return false
+		}
+
+	default:
+		select {
+		case s.ChunkChannel <- frame: // try to send
+		default: // or skip this frame
+			frame.Release()
+			s.drop()
+		}
+		return true
+	}
+}
+
+// releaseQueued drops frames left in the channel after unsubscribing.
+func (s *Subscriber) releaseQueued() {
+	for {
+		select {
+		case frame, ok := <-s.ChunkChannel:
+			if !ok {
+				return
+			}
+			frame.Release()
+		default:
+			return
+		}
+	}
+}
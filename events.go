@@ -0,0 +1,223 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventState      = "state"
+	EventSubscriber = "subscribers"
+	EventTimeout    = "timeout"
+	EventError      = "error"
+	EventStuck      = "stuck"
+)
+
+const eventKeepalive = 30 * time.Second
+
+type Event struct {
+	Type        string    `json:"type"`
+	Source      string    `json:"source"`
+	Time        time.Time `json:"time"`
+	State       string    `json:"state,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Subscribers int       `json:"subscribers"`
+	Error       string    `json:"error,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Message     string    `json:"message"`
+	subsystem   string
+	duration    time.Duration
+}
+
+func (ev Event) logger() *slog.Logger {
+	switch ev.subsystem {
+	case "chunker":
+		return logChunker
+	case "pubsub":
+		return logPubSub
+	default:
+		return logServer
+	}
+}
+
+func (ev Event) level() slog.Level {
+	switch {
+	case ev.Type == EventSubscriber:
+		return subscriberLevel
+	case ev.Type == EventError || ev.State == "failed":
+		return slog.LevelError
+	case ev.Type == EventTimeout || ev.Type == EventStuck:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func (ev Event) log() {
+	attrs := []slog.Attr{slog.String("source", ev.Source)}
+	if ev.State != "" {
+		attrs = append(attrs, slog.String("state", ev.State))
+	}
+	if ev.URL != "" {
+		attrs = append(attrs, slog.String("url", ev.URL))
+	}
+	if ev.Client != "" {
+		attrs = append(attrs, slog.String("client", ev.Client))
+	}
+	if ev.Type == EventSubscriber {
+		attrs = append(attrs, slog.Int("subscribers", ev.Subscribers))
+	}
+	if ev.Error != "" {
+		attrs = append(attrs, slog.String("error", ev.Error))
+	}
+	if ev.duration > 0 {
+		attrs = append(attrs, slog.Duration("duration", ev.duration))
+	}
+
+	ev.logger().LogAttrs(context.Background(), ev.level(), ev.Message, attrs...)
+}
+
+type EventBus struct {
+	mu        sync.Mutex
+	listeners map[chan Event]string
+	counts    map[string]int
+}
+
+var eventBus = NewEventBus()
+
+func NewEventBus() *EventBus {
+	bus := new(EventBus)
+
+	bus.listeners = make(map[chan Event]string)
+	bus.counts = make(map[string]int)
+
+	return bus
+}
+
+func (bus *EventBus) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	bus.mu.Lock()
+	if ev.Type == EventSubscriber {
+		bus.counts[ev.Source] = ev.Subscribers
+	} else {
+		ev.Subscribers = bus.counts[ev.Source]
+	}
+	for ch, source := range bus.listeners {
+		if source != "" && source != ev.Source {
+			continue
+		}
+		select {
+		case ch <- ev: // try to send
+		default: // or drop for slow listener
+		}
+	}
+	bus.mu.Unlock()
+
+	ev.log()
+}
+
+func (bus *EventBus) Subscribe(source string) chan Event {
+	ch := make(chan Event, 64)
+
+	bus.mu.Lock()
+	bus.listeners[ch] = source
+	bus.mu.Unlock()
+
+	return ch
+}
+
+func (bus *EventBus) Unsubscribe(ch chan Event) {
+	bus.mu.Lock()
+	delete(bus.listeners, ch)
+	bus.mu.Unlock()
+}
+
+func (bus *EventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logServer.Warn("client could not be flushed",
+			"source", "events", "client", r.RemoteAddr)
+		return
+	}
+
+	// leave out events of sources the client may not view
+	visible := make(map[string]bool)
+	for _, pubSub := range visibleSources(r) {
+		visible[pubSub.id] = true
+	}
+
+	ch := bus.Subscribe(r.URL.Query().Get("source"))
+	defer bus.Unsubscribe(ch)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepalive)
+	defer ticker.Stop()
+
+	var id uint64
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Source != "" && !visible[ev.Source] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				logServer.Error("event encode failed",
+					"source", "events", "error", err)
+				continue
+			}
+			id++
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, ev.Type, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
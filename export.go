@@ -0,0 +1,549 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportMaxDuration = 10 * time.Minute
+	exportMaxFrames   = 600
+	exportMaxSize     = 1920
+	historyMaxFrames  = 3600
+	exportMaxPixels   = 100 << 20 // all GIF frames together, one byte each
+
+	exportLive    = "live"
+	exportHistory = "history"
+)
+
+// exportSlots limits exports running at the same time, nil if unlimited.
+var exportSlots chan struct{}
+
+// exportParams describe a clip built from frames sampled every interval
+// over the last or next duration.
+type exportParams struct {
+	duration time.Duration
+	interval time.Duration
+	delay    time.Duration
+	width    int
+	height   int
+	mode     string
+}
+
+// frameHistory keeps frames sampled at an interval, owned by the loop.
+type frameHistory struct {
+	interval time.Duration
+	frames   []*Frame
+	next     int
+	last     time.Time
+}
+
+func newFrameHistory(keep, interval time.Duration) *frameHistory {
+	if keep <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	history := new(frameHistory)
+
+	history.interval = interval
+	size := int(keep/interval) + 1
+	if size > historyMaxFrames {
+		size = historyMaxFrames
+	}
+	history.frames = make([]*Frame, size)
+
+	return history
+}
+
+func (history *frameHistory) Add(frame *Frame) {
+	if history == nil || frame.Time.Sub(history.last) < history.interval {
+		return
+	}
+
+	if old := history.frames[history.next]; old != nil {
+		old.Release()
+	}
+	frame.Retain()
+	history.frames[history.next] = frame
+	history.next = (history.next + 1) % len(history.frames)
+	history.last = frame.Time
+}
+
+// Frames returns references to the kept frames, oldest first.
+func (history *frameHistory) Frames() []*Frame {
+	if history == nil {
+		return nil
+	}
+
+	frames := make([]*Frame, 0, len(history.frames))
+	for i := range history.frames {
+		frame := history.frames[(history.next+i)%len(history.frames)]
+		if frame != nil {
+			frame.Retain()
+			frames = append(frames, frame)
+		}
+	}
+
+	return frames
+}
+
+func parseExportDuration(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		// plain numbers are seconds
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", name, value)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+
+	return d, nil
+}
+
+func parseExportParams(r *http.Request, hasHistory bool) (exportParams, error) {
+	var params exportParams
+	var err error
+
+	params.duration, err = parseExportDuration(r, "duration", 10*time.Second)
+	if err != nil {
+		return params, err
+	}
+	params.interval, err = parseExportDuration(r, "interval", time.Second)
+	if err != nil {
+		return params, err
+	}
+	params.delay, err = parseExportDuration(r, "delay", params.interval)
+	if err != nil {
+		return params, err
+	}
+	if params.duration > exportMaxDuration {
+		return params, fmt.Errorf("duration over %s", exportMaxDuration)
+	}
+	if params.duration/params.interval > exportMaxFrames {
+		return params, fmt.Errorf("more than %d frames", exportMaxFrames)
+	}
+
+	for _, size := range []struct {
+		name  string
+		value *int
+	}{{"width", &params.width}, {"height", &params.height}} {
+		value := r.FormValue(size.name)
+		if value == "" {
+			continue
+		}
+		*size.value, err = strconv.Atoi(value)
+		if err != nil || *size.value <= 0 || *size.value > exportMaxSize {
+			return params, fmt.Errorf("invalid %s: %s", size.name, value)
+		}
+	}
+
+	params.mode = r.FormValue("mode")
+	switch params.mode {
+	case "":
+		params.mode = exportLive
+		if hasHistory {
+			params.mode = exportHistory
+		}
+	case exportLive:
+	case exportHistory:
+		if !hasHistory {
+			return params, errors.New("source keeps no history")
+		}
+	default:
+		return params, fmt.Errorf("invalid mode: %s", params.mode)
+	}
+
+	return params, nil
+}
+
+// historyFrames returns references to the history frames within the
+// last duration, one per interval.
+func (pubSub *PubSub) historyFrames(params exportParams) []*Frame {
+	reply := make(chan []*Frame, 1)
+	pubSub.historyChan <- reply
+	kept := <-reply
+
+	var frames []*Frame
+	var last time.Time
+	since := time.Now().Add(-params.duration)
+	for _, frame := range kept {
+		if frame.Time.Before(since) || frame.Time.Sub(last) < params.interval {
+			frame.Release()
+			continue
+		}
+		frames = append(frames, frame)
+		last = frame.Time
+	}
+
+	return frames
+}
+
+// collectFrames passes one frame per interval to handle, from the
+// history or live from the source. Frames are released after handle
+// returns, so only the frame being encoded is held.
+func (pubSub *PubSub) collectFrames(r *http.Request, params exportParams, handle func(*Frame) error) error {
+	if params.mode == exportHistory {
+		frames := pubSub.historyFrames(params)
+		var err error
+		for _, frame := range frames {
+			if err == nil {
+				err = handle(frame)
+			}
+			frame.Release()
+		}
+		return err
+	}
+
+	return pubSub.recordFrames(r, params, handle)
+}
+
+// recordFrames follows the source for the duration and passes on one
+// frame per interval. It stops early if the request is cancelled.
+func (pubSub *PubSub) recordFrames(r *http.Request, params exportParams, handle func(*Frame) error) error {
+	sub := NewSubscriber(clientAddress(r))
+	sub.Source = pubSub.id
+	sub.setDelivery(deliveryLatest, 1)
+	err := viewerLimits.Acquire(pubSub, sub)
+	if err != nil {
+		return err
+	}
+	defer viewerLimits.Release(sub)
+
+	pubSub.Subscribe(sub)
+	defer func() {
+		pubSub.Unsubscribe(sub)
+		sub.releaseQueued()
+	}()
+
+	timer := time.NewTimer(params.duration)
+	defer timer.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case frame, ok := <-sub.ChunkChannel:
+			if !ok {
+				return nil
+			}
+			if frame.Time.Sub(last) < params.interval {
+				frame.Release()
+				continue
+			}
+			last = frame.Time
+			err = handle(frame)
+			frame.Release()
+			if err != nil {
+				return err
+			}
+		case <-timer.C:
+			return nil
+		case <-sub.evict:
+			return nil
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// exportSize returns the output size, keeping the aspect ratio when
+// only one side is given.
+func exportSize(params exportParams, src image.Rectangle) image.Point {
+	w, h := params.width, params.height
+	switch {
+	case w == 0 && h == 0:
+		return src.Size()
+	case h == 0:
+		h = w * src.Dy() / src.Dx()
+	case w == 0:
+		w = h * src.Dx() / src.Dy()
+	}
+	if w <= 0 {
+		w = 1
+	}
+	if h <= 0 {
+		h = 1
+	}
+
+	return image.Pt(w, h)
+}
+
+// gifEncoder converts frames to paletted images as they arrive, so the
+// JPEG frames and full size images are not kept for the whole clip.
+type gifEncoder struct {
+	params exportParams
+	frames int // expected number of frames
+	delay  int
+	size   image.Point
+	anim   gif.GIF
+}
+
+func newGIFEncoder(params exportParams) *gifEncoder {
+	enc := new(gifEncoder)
+
+	enc.params = params
+	enc.frames = int(params.duration/params.interval) + 1
+	enc.delay = int(params.delay / (10 * time.Millisecond))
+	if enc.delay < 2 {
+		enc.delay = 2 // browsers slow down shorter delays
+	}
+
+	return enc
+}
+
+// Add appends the frame, skipping images that do not decode.
+func (enc *gifEncoder) Add(frame *Frame) error {
+	src, err := decodeJPEG(frame.Data)
+	if err != nil {
+		return nil
+	}
+	if enc.size == (image.Point{}) {
+		enc.size = exportSize(enc.params, src.Bounds())
+
+		// scale down so the whole clip fits the memory budget
+		pixels := enc.size.X * enc.size.Y * enc.frames
+		if pixels > exportMaxPixels {
+			scale := math.Sqrt(float64(exportMaxPixels) / float64(pixels))
+			enc.size.X = max(1, int(float64(enc.size.X)*scale))
+			enc.size.Y = max(1, int(float64(enc.size.Y)*scale))
+		}
+	}
+
+	scaled := image.NewRGBA(image.Rectangle{Max: enc.size})
+	scaleImage(scaled, src)
+	paletted := image.NewPaletted(scaled.Bounds(), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), scaled, image.Point{})
+
+	enc.anim.Image = append(enc.anim.Image, paletted)
+	enc.anim.Delay = append(enc.anim.Delay, enc.delay)
+
+	return nil
+}
+
+func (enc *gifEncoder) Len() int {
+	return len(enc.anim.Image)
+}
+
+func (enc *gifEncoder) Encode() ([]byte, error) {
+	if len(enc.anim.Image) == 0 {
+		return nil, errors.New("no frames to export")
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &enc.anim)
+	return buf.Bytes(), err
+}
+
+// resizeJPEG re-encodes the frame at the requested size, or returns the
+// original data if no size was requested.
+func resizeJPEG(data []byte, params exportParams) ([]byte, error) {
+	if params.width == 0 && params.height == 0 {
+		return data, nil
+	}
+
+	src, err := decodeJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	scaled := image.NewRGBA(image.Rectangle{Max: exportSize(params, src.Bounds())})
+	scaleImage(scaled, src)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, scaled, nil)
+	return buf.Bytes(), err
+}
+
+func exportFilename(path, ext string) string {
+	name := strings.Trim(strings.ReplaceAll(path, "/", "-"), "-")
+	if name == "" {
+		name = "stream"
+	}
+
+	return fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), ext)
+}
+
+// serveExport answers ?action=gif and ?action=timelapse with a clip
+// for download.
+func (pubSub *PubSub) serveExport(w http.ResponseWriter, r *http.Request, session *accessSession, format string) {
+	if !pubSub.schedule.Open(time.Now()) {
+		pubSub.serveClosed(w, r, session)
+		return
+	}
+
+	err := r.ParseForm()
+	if err == nil {
+		var params exportParams
+		params, err = parseExportParams(r, pubSub.history != nil)
+		if err == nil {
+			if !acquireExport() {
+				session.status = http.StatusServiceUnavailable
+				session.reason = reasonOverLimit
+				w.Header().Set("Retry-After", viewerLimits.RetryAfter())
+				http.Error(w, "Too many exports running", http.StatusServiceUnavailable)
+				return
+			}
+			defer releaseExport()
+
+			pubSub.export(w, r, session, format, params)
+			return
+		}
+	}
+
+	session.status = http.StatusBadRequest
+	session.reason = reasonBadRequest
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func acquireExport() bool {
+	if exportSlots == nil {
+		return true
+	}
+
+	select {
+	case exportSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseExport() {
+	if exportSlots != nil {
+		<-exportSlots
+	}
+}
+
+func (pubSub *PubSub) exportFailed(w http.ResponseWriter, r *http.Request, session *accessSession, err error) {
+	if r.Context().Err() != nil {
+		session.status = statusClientClosed
+		session.reason = reasonClientClosed
+		return
+	}
+
+	session.status = http.StatusServiceUnavailable
+	session.reason = reasonSourceFailed
+	logServer.Debug("export failed", "source", pubSub.id, "client", r.RemoteAddr, "error", err)
+	http.Error(w, "Export failed: "+err.Error(), http.StatusServiceUnavailable)
+}
+
+func (pubSub *PubSub) export(w http.ResponseWriter, r *http.Request, session *accessSession,
+	format string, params exportParams) {
+	cw := &countingWriter{w: w}
+	defer func() {
+		session.bytes = cw.n
+	}()
+
+	header := w.Header()
+	if format == "gif" {
+		enc := newGIFEncoder(params)
+		err := pubSub.collectFrames(r, params, enc.Add)
+		if err == nil && enc.Len() == 0 {
+			err = errors.New("no frames received")
+		}
+		if err != nil {
+			pubSub.exportFailed(w, r, session, err)
+			return
+		}
+
+		data, err := enc.Encode()
+		if err != nil {
+			session.status = http.StatusInternalServerError
+			session.reason = reasonWriteFailed
+			http.Error(w, "Export failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		header.Set("Content-Type", "image/gif")
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(pubSub.id, "gif")))
+		w.WriteHeader(http.StatusOK)
+		session.status = http.StatusOK
+		_, err = cw.Write(data)
+		if err != nil {
+			session.reason = reasonWriteFailed
+			return
+		}
+		session.frames = uint64(enc.Len())
+		return
+	}
+
+	// parts are written as they arrive, the header with the first one
+	boundary := randomBoundary()
+	pw := newPartWriter(cw, boundary)
+	var writeErr error
+	err := pubSub.collectFrames(r, params, func(frame *Frame) error {
+		data, err := resizeJPEG(frame.Data, params)
+		if err != nil {
+			return nil
+		}
+		if session.status == 0 {
+			header.Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", boundary))
+			header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(pubSub.id, "mjpeg")))
+			w.WriteHeader(http.StatusOK)
+			session.status = http.StatusOK
+		}
+		part := &Frame{Data: data, Seq: frame.Seq, Time: frame.Time, Header: frame.Header} // not pooled
+		part.Width, part.Height, _ = jpegSize(data)
+		writeErr = pw.WriteFrame(part)
+		if writeErr != nil {
+			return writeErr
+		}
+		session.frames++
+		return nil
+	})
+	if session.status == 0 {
+		if err == nil {
+			err = errors.New("no frames received")
+		}
+		pubSub.exportFailed(w, r, session, err)
+		return
+	}
+	if writeErr == nil {
+		writeErr = pw.Close()
+	}
+	if writeErr != nil {
+		session.reason = reasonWriteFailed
+	} else if err != nil {
+		session.reason = reasonClientClosed
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs is a 5x7 bitmap font, one byte per row with the leftmost
+// pixel in bit 4. Lowercase letters are drawn as uppercase.
+var glyphs = map[rune][glyphHeight]byte{
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	' ': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'/': {0x01, 0x02, 0x02, 0x04, 0x08, 0x08, 0x10},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'?': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+}
+
+// textSize returns the size of the text drawn at the given scale.
+func textSize(text string, scale int) image.Point {
+	n := utf8.RuneCountInString(text)
+	if n == 0 {
+		return image.Point{}
+	}
+
+	return image.Pt((n*(glyphWidth+1)-1)*scale, glyphHeight*scale)
+}
+
+// drawText draws the text with its top left corner at pt, clipped to
+// the image bounds.
+func drawText(img *image.RGBA, pt image.Point, text string, scale int, c color.RGBA) {
+	bounds := img.Bounds()
+	x := pt.X
+	for _, r := range strings.ToUpper(text) {
+		glyph, ok := glyphs[r]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		for row := 0; row < glyphHeight; row++ {
+			for col := 0; col < glyphWidth; col++ {
+				if glyph[row]&(0x10>>col) == 0 {
+					continue
+				}
+				dot := image.Rect(x+col*scale, pt.Y+row*scale,
+					x+(col+1)*scale, pt.Y+(row+1)*scale).Intersect(bounds)
+				for py := dot.Min.Y; py < dot.Max.Y; py++ {
+					for px := dot.Min.X; px < dot.Max.X; px++ {
+						img.SetRGBA(px, py, c)
+					}
+				}
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frame is a reference counted JPEG image. The buffer goes back to the
+// pool once the chunker, the loop and every subscriber released it, so
+// nobody may keep Data after calling Release.
+type Frame struct {
+	refs   int32
+	Data   []byte
+	Seq    uint64
+	Time   time.Time
+	Header textproto.MIMEHeader
+	Width  int
+	Height int
+	shared *Frame // frame owning Data, released with this one
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(Frame)
+	},
+}
+
+// maxPresize limits the buffer allocated up front from the part
+// Content-Length, larger frames grow the buffer while reading.
+const maxPresize = 8 << 20
+
+// newFrame returns a frame with one reference and room for size bytes.
+func newFrame(size int) *Frame {
+	frame := framePool.Get().(*Frame)
+
+	if size > maxPresize {
+		size = maxPresize
+	}
+
+	// leave room for the final read that returns io.EOF
+	if cap(frame.Data) < size+bytes.MinRead {
+		frame.Data = make([]byte, 0, size+bytes.MinRead)
+	}
+	frame.Data = frame.Data[:0]
+	frame.refs = 1
+	frame.Seq = 0
+	frame.Time = time.Time{}
+	frame.Header = nil
+	frame.Width = 0
+	frame.Height = 0
+
+	return frame
+}
+
+// shareFrame returns a frame with its own reference count and metadata
+// that shares the data of frame. It takes over the caller's reference,
+// which is released together with the returned frame.
+func shareFrame(frame *Frame) *Frame {
+	out := framePool.Get().(*Frame)
+
+	out.refs = 1
+	out.Data = frame.Data
+	out.Seq = frame.Seq
+	out.Time = frame.Time
+	out.Header = frame.Header
+	out.Width = frame.Width
+	out.Height = frame.Height
+	out.shared = frame
+
+	return out
+}
+
+// readFrame reads a part into a pooled buffer, sized by the part
+// Content-Length when the source sends one.
+func readFrame(r io.Reader, contentLength string) (*Frame, error) {
+	size, err := strconv.Atoi(contentLength)
+	if err != nil || size < 0 {
+		size = 0
+	}
+
+	frame := newFrame(size)
+	buf := bytes.NewBuffer(frame.Data)
+	_, err = buf.ReadFrom(r)
+	frame.Data = buf.Bytes()
+	if err != nil {
+		frame.Release()
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (frame *Frame) Retain() {
+	atomic.AddInt32(&frame.refs, 1)
+}
+
+func (frame *Frame) Release() {
+	refs := atomic.AddInt32(&frame.refs, -1)
+	if refs == 0 {
+		if shared := frame.shared; shared != nil {
+			// the buffer belongs to the shared frame
+			frame.shared = nil
+			frame.Data = nil
+			shared.Release()
+		}
+		framePool.Put(frame)
+	} else if refs < 0 {
+		panic("frame released too many times")
+	}
+}
+
+// jpegSize reads the image dimensions from the SOF segment.
+func jpegSize(data []byte) (int, int, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, 0, false
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return 0, 0, false
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8) { // no length
+			i += 2
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 { // image data or end
+			return 0, 0, false
+		}
+
+		length := int(data[i+2])<<8 | int(data[i+3])
+		isSOF := marker >= 0xc0 && marker <= 0xcf &&
+			marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+		if isSOF {
+			if i+9 > len(data) {
+				return 0, 0, false
+			}
+			height := int(data[i+5])<<8 | int(data[i+6])
+			width := int(data[i+7])<<8 | int(data[i+8])
+			return width, height, true
+		}
+		i += 2 + length
+	}
+
+	return 0, 0, false
+}
+
+func appendTimestamp(b []byte, t time.Time) []byte {
+	usec := t.UnixNano() / int64(time.Microsecond)
+	b = strconv.AppendInt(b, usec/1000000, 10)
+	b = append(b, '.')
+	frac := strconv.AppendInt(nil, 1000000+usec%1000000, 10)
+	return append(b, frac[1:]...)
+}
+
+func appendHeader(b []byte, key string, value []byte) []byte {
+	b = append(b, key...)
+	b = append(b, ": "...)
+	b = append(b, value...)
+	return append(b, "\r\n"...)
+}
+
+func randomBoundary() string {
+	var buf [30]byte
+	rand.Read(buf[:])
+
+	return fmt.Sprintf("%x", buf[:])
+}
+
+// partWriter writes frames as multipart/x-mixed-replace parts. Each
+// part goes out in a single write from a pooled buffer, so the response
+// sends it as one chunk instead of flushing the header on its own.
+type partWriter struct {
+	w        io.Writer
+	boundary string
+	header   []byte
+	started  bool
+}
+
+// partPool holds buffers for whole parts, shared by all viewers.
+var partPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+func newPartWriter(w io.Writer, boundary string) *partWriter {
+	pw := new(partWriter)
+
+	pw.w = w
+	pw.boundary = boundary
+
+	return pw
+}
+
+func (pw *partWriter) WriteFrame(frame *Frame) error {
+	buf := partPool.Get().(*[]byte)
+	defer partPool.Put(buf)
+
+	part := (*buf)[:0]
+	if pw.started {
+		part = append(part, "\r\n"...)
+	}
+	part = append(part, "--"...)
+	part = append(part, pw.boundary...)
+	part = append(part, "\r\nContent-Type: image/jpeg\r\nContent-Length: "...)
+	part = strconv.AppendInt(part, int64(len(frame.Data)), 10)
+	part = append(part, "\r\n"...)
+	part = appendFrameHeaders(part, frame)
+	part = append(part, "\r\n"...)
+	part = append(part, frame.Data...)
+	pw.started = true
+	*buf = part
+
+	_, err := pw.w.Write(part)
+	return err
+}
+
+// appendFrameHeaders adds the frame metadata and the X- headers sent by
+// the source. A camera provided X-Timestamp is kept as the capture time.
+func appendFrameHeaders(b []byte, frame *Frame) []byte {
+	var num []byte
+
+	num = strconv.AppendUint(num[:0], frame.Seq, 10)
+	b = appendHeader(b, "X-Frame-Seq", num)
+
+	if !frame.Time.IsZero() {
+		num = appendTimestamp(num[:0], frame.Time)
+		b = appendHeader(b, "X-Receive-Timestamp", num)
+		if frame.Header.Get("X-Timestamp") == "" {
+			b = appendHeader(b, "X-Timestamp", num)
+		}
+	}
+
+	if frame.Width > 0 && frame.Height > 0 {
+		num = strconv.AppendInt(num[:0], int64(frame.Width), 10)
+		b = appendHeader(b, "X-Frame-Width", num)
+		num = strconv.AppendInt(num[:0], int64(frame.Height), 10)
+		b = appendHeader(b, "X-Frame-Height", num)
+	}
+
+	for key, values := range frame.Header {
+		if !strings.HasPrefix(key, "X-") {
+			continue
+		}
+		switch key {
+		case "X-Frame-Seq", "X-Receive-Timestamp", "X-Frame-Width", "X-Frame-Height":
+			continue
+		}
+		for _, value := range values {
+			b = appendHeader(b, key, []byte(value))
+		}
+	}
+
+	return b
+}
+
+func (pw *partWriter) Close() error {
+	pw.header = pw.header[:0]
+	if pw.started {
+		pw.header = append(pw.header, "\r\n"...)
+	}
+	pw.header = append(pw.header, "--"...)
+	pw.header = append(pw.header, pw.boundary...)
+	pw.header = append(pw.header, "--\r\n"...)
+
+	_, err := pw.w.Write(pw.header)
+	return err
+}
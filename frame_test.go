@@ -0,0 +1,186 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+const benchFrameSize = 200 * 1024
+
+// repeatReader returns the same data over and over.
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+func benchPart() []byte {
+	data := bytes.Repeat([]byte{0xaa}, benchFrameSize)
+
+	var part bytes.Buffer
+	fmt.Fprintf(&part, "--myboundary\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(data))
+	part.Write(data)
+	part.WriteString("\r\n")
+
+	return part.Bytes()
+}
+
+func TestReadFrameContentLength(t *testing.T) {
+	frame, err := readFrame(bytes.NewReader([]byte{0xff, 0xd8}), "999999999999999999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Data) != 2 {
+		t.Fatalf("read %d bytes", len(frame.Data))
+	}
+	frame.Release()
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	mr := multipart.NewReader(&repeatReader{data: benchPart()}, "myboundary")
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	for i := 0; i < b.N; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		frame, err := readFrame(part, part.Header.Get("Content-Length"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(frame.Data) != benchFrameSize {
+			b.Fatalf("read %d bytes", len(frame.Data))
+		}
+		frame.Release()
+	}
+}
+
+// BenchmarkReadFrameReadAll reads parts the way the proxy did before
+// frames were pooled, as a baseline for BenchmarkReadFrame.
+func BenchmarkReadFrameReadAll(b *testing.B) {
+	mr := multipart.NewReader(&repeatReader{data: benchPart()}, "myboundary")
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	for i := 0; i < b.N; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(data) != benchFrameSize {
+			b.Fatalf("read %d bytes", len(data))
+		}
+	}
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	frame := newFrame(benchFrameSize)
+	frame.Data = append(frame.Data, bytes.Repeat([]byte{0xaa}, benchFrameSize)...)
+	frame.Time = time.Now()
+	frame.Width = 1920
+	frame.Height = 1080
+	pw := newPartWriter(io.Discard, randomBoundary())
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	for i := 0; i < b.N; i++ {
+		frame.Seq++
+		err := pw.WriteFrame(frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteFrameMultipart writes parts the way the proxy did before
+// the part writer, as a baseline for BenchmarkWriteFrame.
+func BenchmarkWriteFrameMultipart(b *testing.B) {
+	data := bytes.Repeat([]byte{0xaa}, benchFrameSize)
+	mw := multipart.NewWriter(io.Discard)
+	mimeHeader := make(textproto.MIMEHeader)
+	mimeHeader.Set("Content-Type", "image/jpeg")
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	for i := 0; i < b.N; i++ {
+		mimeHeader.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		part, err := mw.CreatePart(mimeHeader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = part.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteFrameResponse writes parts through an HTTP response to
+// a client reading over a local connection.
+func BenchmarkWriteFrameResponse(b *testing.B) {
+	frame := newFrame(benchFrameSize)
+	frame.Data = append(frame.Data, bytes.Repeat([]byte{0xaa}, benchFrameSize)...)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := newPartWriter(w, "myboundary")
+		for i := 0; i < b.N; i++ {
+			frame.Seq++
+			err := pw.WriteFrame(frame)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(benchFrameSize)
+	b.ResetTimer()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
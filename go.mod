@@ -1 +1,3 @@
 module github.com/vvidic/mjpeg-proxy
+
+go 1.21
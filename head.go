@@ -0,0 +1,157 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+var headCacheTime time.Duration
+
+// probeCache remembers the result of the last source probe so that
+// monitoring HEAD requests reach the camera at most once per period.
+type probeCache struct {
+	mu   sync.Mutex
+	time time.Time
+	err  error
+}
+
+// Probe connects to the source only to check the response headers,
+// without publishing events or touching the stream state. Virtual
+// sources are available when any of their inputs is.
+func (chunker *Chunker) Probe() error {
+	if chunker.virtual != nil {
+		return probeInputs(chunker.virtual.sources())
+	}
+
+	probe, err := NewChunker(chunker.id, chunker.source.String(),
+		chunker.username, chunker.password, chunker.digest, 0)
+	if err != nil {
+		return err
+	}
+	probe.quiet = true
+	probe.timeout = probeTimeout
+
+	err = probe.connect()
+	if err != nil {
+		return err
+	}
+	probe.cancel()
+	probe.closeResponse(probe.resp)
+
+	return nil
+}
+
+func probeInputs(paths []string) error {
+	err := errors.New("no inputs available")
+	for _, path := range paths {
+		pubSub := findSource(path)
+		if pubSub == nil {
+			continue
+		}
+		err = pubSub.available()
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// available checks an input of a virtual source. Virtual inputs are not
+// probed again to avoid following loops between mosaics.
+func (pubSub *PubSub) available() error {
+	state, lastFrame, _ := pubSub.chunker.Stats()
+	if state == "started" || (state != "failed" && !lastFrame.IsZero() && time.Since(lastFrame) < headCacheTime) {
+		return nil
+	}
+
+	if pubSub.chunker.virtual != nil {
+		probeTime, err := pubSub.lastProbe()
+		if probeTime.IsZero() {
+			return fmt.Errorf("%s: %s", pubSub.id, state)
+		}
+		return err
+	}
+
+	_, err := pubSub.probe(headCacheTime)
+	return err
+}
+
+// probe returns the cached probe result, probing again if it is older
+// than maxAge.
+func (pubSub *PubSub) probe(maxAge time.Duration) (time.Time, error) {
+	cache := &pubSub.probeCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.time.IsZero() || time.Since(cache.time) >= maxAge {
+		cache.err = pubSub.chunker.Probe()
+		cache.time = time.Now()
+		logChunker.Debug("source probed", "source", pubSub.id, "error", cache.err)
+	}
+
+	return cache.time, cache.err
+}
+
+// serveHead answers HEAD requests without subscribing. A source that is
+// streaming or delivered frames recently is reported healthy, otherwise
+// a cached probe result is used. The Content-Type defaults to the stream.
+func (pubSub *PubSub) serveHead(w http.ResponseWriter, session *accessSession, contentType string) {
+	state, lastFrame, _ := pubSub.chunker.Stats()
+
+	header := w.Header()
+	header.Set("Cache-Control", "no-cache")
+	if !lastFrame.IsZero() {
+		age := time.Since(lastFrame).Seconds()
+		header.Set("X-Last-Frame-Age", strconv.FormatFloat(age, 'f', 3, 64))
+	}
+
+	status := http.StatusOK
+	recent := !lastFrame.IsZero() && time.Since(lastFrame) < headCacheTime
+	if state == "started" || (recent && state != "failed") {
+		header.Set("X-Source-State", state)
+	} else {
+		probeTime, err := pubSub.probe(headCacheTime)
+		header.Set("X-Probe-Age", strconv.FormatFloat(time.Since(probeTime).Seconds(), 'f', 3, 64))
+		if err != nil {
+			header.Set("X-Source-State", "failed")
+			status = http.StatusServiceUnavailable
+		} else {
+			header.Set("X-Source-State", "available")
+		}
+	}
+
+	if status == http.StatusOK {
+		if contentType == "" {
+			contentType = fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", randomBoundary())
+		}
+		header.Set("Content-Type", contentType)
+	}
+	session.status = status
+	w.WriteHeader(status)
+}
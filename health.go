@@ -0,0 +1,147 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+var (
+	readyMaxAge   time.Duration
+	probeInterval time.Duration
+)
+
+type SourceReadiness struct {
+	Path     string `json:"path"`
+	Critical bool   `json:"critical"`
+	Ready    bool   `json:"ready"`
+	Unknown  bool   `json:"unknown,omitempty"` // idle and not probed, left out
+	Reason   string `json:"reason"`
+}
+
+type ReadinessReport struct {
+	Ready   bool              `json:"ready"`
+	Sources []SourceReadiness `json:"sources"`
+}
+
+// lastProbe returns the cached probe result without probing.
+func (pubSub *PubSub) lastProbe() (time.Time, error) {
+	cache := &pubSub.probeCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.time, cache.err
+}
+
+// Readiness reports whether the source delivered a frame or answered
+// a probe within readyMaxAge. Without background probes the state of an
+// idle source is unknown.
+func (pubSub *PubSub) Readiness() SourceReadiness {
+	readiness := SourceReadiness{
+		Path:     pubSub.id,
+		Critical: pubSub.critical,
+	}
+
+	if !pubSub.schedule.Open(time.Now()) {
+		readiness.Ready = true
+		readiness.Reason = "outside schedule"
+		return readiness
+	}
+
+	state, lastFrame, _ := pubSub.chunker.Stats()
+	probeTime, probeErr := pubSub.lastProbe()
+
+	switch {
+	case !lastFrame.IsZero() && time.Since(lastFrame) < readyMaxAge:
+		readiness.Ready = true
+		readiness.Reason = "frame received"
+	case !probeTime.IsZero() && time.Since(probeTime) < readyMaxAge && probeErr == nil:
+		readiness.Ready = true
+		readiness.Reason = "probe succeeded"
+	case !probeTime.IsZero() && time.Since(probeTime) < readyMaxAge:
+		readiness.Reason = "probe failed"
+	case state == "failed":
+		readiness.Reason = "source failed"
+	case probeInterval == 0 && state != "started" && state != "connecting":
+		readiness.Unknown = true
+		readiness.Reason = "unknown"
+	default:
+		readiness.Reason = "no recent frame"
+	}
+
+	return readiness
+}
+
+// probeLoop checks idle sources in the background. Sources that are
+// streaming or outside their schedule are not probed, and probes share
+// the HEAD cache so the camera is contacted at most once per interval.
+func (pubSub *PubSub) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		state, _, _ := pubSub.chunker.Stats()
+		idle := state != "started" && state != "connecting"
+		if idle && pubSub.schedule.Open(time.Now()) {
+			pubSub.probe(interval / 2)
+		}
+		<-ticker.C
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err := w.Write([]byte("ok\n"))
+	if err != nil {
+		logServer.Debug("health write failed", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// readyHandler fails when any critical source is not ready, sources
+// in an unknown state do not count.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	report := ReadinessReport{
+		Ready:   true,
+		Sources: make([]SourceReadiness, 0, len(proxySources)),
+	}
+	for _, pubSub := range proxySources {
+		readiness := pubSub.Readiness()
+		if readiness.Critical && !readiness.Ready && !readiness.Unknown {
+			report.Ready = false
+		}
+		report.Sources = append(report.Sources, readiness)
+	}
+
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		logServer.Debug("readiness write failed", "client", r.RemoteAddr, "error", err)
+	}
+}
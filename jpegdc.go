@@ -0,0 +1,379 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+// Dedup only needs a coarse picture of each frame. A baseline JPEG
+// stores the mean of every 8x8 block as its DC coefficient, so reading
+// only those gives the image at 1/8 scale without the inverse DCT,
+// upsampling and color conversion of a full decode.
+
+var (
+	errDCUnsupported = errors.New("unsupported JPEG for DC decode")
+	errDCCorrupt     = errors.New("corrupt JPEG data")
+)
+
+// huffTable decodes the canonical codes of a DHT table.
+type huffTable struct {
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+	vals    []byte
+}
+
+func newHuffTable(counts []byte, vals []byte) *huffTable {
+	t := new(huffTable)
+	t.vals = vals
+
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		t.valPtr[l] = k
+		t.minCode[l] = code
+		t.maxCode[l] = -1
+		if n > 0 {
+			t.maxCode[l] = code + n - 1
+		}
+		code = (code + n) << 1
+		k += n
+	}
+
+	return t
+}
+
+type dcComponent struct {
+	id     byte
+	h, v   int
+	tq     byte
+	dc, ac *huffTable
+	pred   int32
+}
+
+// dcDecoder reads the entropy coded data of a baseline scan.
+type dcDecoder struct {
+	data   []byte
+	pos    int
+	bits   uint32 // next bits, most significant first
+	nbits  uint
+	marker bool // stopped at a marker, feeding zeros
+
+	quant [4]int32 // DC quantizer of each table
+	dc    [4]*huffTable
+	ac    [4]*huffTable
+
+	width, height int
+	comps         []dcComponent
+	restart       int
+}
+
+func (d *dcDecoder) fill() {
+	for d.nbits <= 24 {
+		var b byte
+		if !d.marker && d.pos < len(d.data) {
+			b = d.data[d.pos]
+			if b == 0xff {
+				if d.pos+1 < len(d.data) && d.data[d.pos+1] == 0 {
+					d.pos += 2 // stuffed byte
+				} else {
+					d.marker = true
+					b = 0
+				}
+			} else {
+				d.pos++
+			}
+		}
+		d.bits |= uint32(b) << (24 - d.nbits)
+		d.nbits += 8
+	}
+}
+
+func (d *dcDecoder) receive(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	d.fill()
+	v := int32(d.bits >> (32 - n))
+	d.bits <<= n
+	d.nbits -= n
+
+	// extend to a signed value
+	if v < 1<<(n-1) {
+		v += -1<<n + 1
+	}
+	return v
+}
+
+func (d *dcDecoder) decodeHuff(t *huffTable) (byte, error) {
+	d.fill()
+	for l := uint(1); l <= 16; l++ {
+		code := int32(d.bits >> (32 - l))
+		if code <= t.maxCode[l] {
+			d.bits <<= l
+			d.nbits -= l
+			return t.vals[t.valPtr[l]+code-t.minCode[l]], nil
+		}
+	}
+
+	return 0, errDCCorrupt
+}
+
+// restartScan skips the RSTn marker ending a restart interval.
+func (d *dcDecoder) restartScan() {
+	d.bits, d.nbits, d.marker = 0, 0, false
+	for d.pos+1 < len(d.data) {
+		if d.data[d.pos] == 0xff && d.data[d.pos+1] >= 0xd0 && d.data[d.pos+1] <= 0xd7 {
+			d.pos += 2
+			break
+		}
+		d.pos++
+	}
+	for i := range d.comps {
+		d.comps[i].pred = 0
+	}
+}
+
+// jpegDC decodes the block means of the first component, the luma of
+// color images, as a gray image 1/8 the size. Progressive and other
+// non-baseline images return errDCUnsupported.
+func jpegDC(data []byte) (*image.Gray, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errDCCorrupt
+	}
+
+	d := &dcDecoder{data: data}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, errDCCorrupt
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if end > len(data) {
+			return nil, errDCCorrupt
+		}
+		segment := data[i+4 : end]
+
+		var err error
+		switch {
+		case marker == 0xdb:
+			err = d.parseDQT(segment)
+		case marker == 0xc4:
+			err = d.parseDHT(segment)
+		case marker == 0xc0 || marker == 0xc1:
+			err = d.parseSOF(segment)
+		case marker >= 0xc2 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return nil, errDCUnsupported
+		case marker == 0xdd:
+			if len(segment) < 2 {
+				return nil, errDCCorrupt
+			}
+			d.restart = int(segment[0])<<8 | int(segment[1])
+		case marker == 0xda:
+			err = d.parseSOS(segment)
+			if err != nil {
+				return nil, err
+			}
+			d.data = data[end:]
+			return d.decodeScan()
+		case marker == 0xd9:
+			return nil, errDCCorrupt
+		}
+		if err != nil {
+			return nil, err
+		}
+		i = end
+	}
+
+	return nil, errDCCorrupt
+}
+
+func (d *dcDecoder) parseDQT(segment []byte) error {
+	for len(segment) > 0 {
+		precision, id := segment[0]>>4, segment[0]&0x0f
+		size := 1 + 64
+		if precision != 0 {
+			size = 1 + 128
+		}
+		if id > 3 || len(segment) < size {
+			return errDCCorrupt
+		}
+		if precision != 0 {
+			d.quant[id] = int32(segment[1])<<8 | int32(segment[2])
+		} else {
+			d.quant[id] = int32(segment[1])
+		}
+		segment = segment[size:]
+	}
+
+	return nil
+}
+
+func (d *dcDecoder) parseDHT(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errDCCorrupt
+		}
+		class, id := segment[0]>>4, segment[0]&0x0f
+		counts := segment[1:17]
+		n := 0
+		for _, c := range counts {
+			n += int(c)
+		}
+		if class > 1 || id > 3 || len(segment) < 17+n {
+			return errDCCorrupt
+		}
+
+		t := newHuffTable(counts, segment[17:17+n])
+		if class == 0 {
+			d.dc[id] = t
+		} else {
+			d.ac[id] = t
+		}
+		segment = segment[17+n:]
+	}
+
+	return nil
+}
+
+func (d *dcDecoder) parseSOF(segment []byte) error {
+	if len(segment) < 6 || segment[0] != 8 {
+		return errDCUnsupported
+	}
+	d.height = int(segment[1])<<8 | int(segment[2])
+	d.width = int(segment[3])<<8 | int(segment[4])
+	n := int(segment[5])
+	if d.width == 0 || d.height == 0 || n == 0 || len(segment) < 6+3*n {
+		return errDCCorrupt
+	}
+
+	d.comps = make([]dcComponent, n)
+	for c := range d.comps {
+		p := segment[6+3*c:]
+		d.comps[c] = dcComponent{id: p[0], h: int(p[1] >> 4), v: int(p[1] & 0x0f), tq: p[2] & 0x03}
+		if d.comps[c].h < 1 || d.comps[c].h > 4 || d.comps[c].v < 1 || d.comps[c].v > 4 {
+			return errDCCorrupt
+		}
+	}
+
+	return nil
+}
+
+func (d *dcDecoder) parseSOS(segment []byte) error {
+	if d.comps == nil || len(segment) < 1 {
+		return errDCCorrupt
+	}
+	n := int(segment[0])
+	if len(segment) < 1+2*n {
+		return errDCCorrupt
+	}
+	// only a single scan holding every component can be read here
+	if n != len(d.comps) {
+		return errDCUnsupported
+	}
+
+	for s := 0; s < n; s++ {
+		id, tables := segment[1+2*s], segment[2+2*s]
+		c := &d.comps[s]
+		if c.id != id {
+			return errDCUnsupported
+		}
+		c.dc, c.ac = d.dc[tables>>4&0x03], d.ac[tables&0x03]
+		if c.dc == nil || c.ac == nil {
+			return errDCCorrupt
+		}
+	}
+
+	return nil
+}
+
+func (d *dcDecoder) decodeScan() (*image.Gray, error) {
+	hmax, vmax := 1, 1
+	for _, c := range d.comps {
+		hmax = max(hmax, c.h)
+		vmax = max(vmax, c.v)
+	}
+	if len(d.comps) == 1 { // a single component has one block per MCU
+		d.comps[0].h, d.comps[0].v = 1, 1
+		hmax, vmax = 1, 1
+	}
+
+	mcusX := (d.width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (d.height + 8*vmax - 1) / (8 * vmax)
+	luma := &d.comps[0]
+	stride := mcusX * luma.h
+	pix := make([]byte, stride*mcusY*luma.v)
+	quant := d.quant[luma.tq]
+
+	for mcu := 0; mcu < mcusX*mcusY; mcu++ {
+		if d.restart > 0 && mcu > 0 && mcu%d.restart == 0 {
+			d.restartScan()
+		}
+		mx, my := mcu%mcusX, mcu/mcusX
+
+		for c := range d.comps {
+			comp := &d.comps[c]
+			for v := 0; v < comp.v; v++ {
+				for h := 0; h < comp.h; h++ {
+					s, err := d.decodeHuff(comp.dc)
+					if err != nil {
+						return nil, err
+					}
+					comp.pred += d.receive(uint(s & 0x0f))
+					if c == 0 {
+						// the DC term is 8 times the block mean
+						mean := comp.pred*quant/8 + 128
+						pix[(my*luma.v+v)*stride+mx*luma.h+h] = byte(min(max(mean, 0), 255))
+					}
+
+					// skip the AC coefficients
+					for k := 1; k < 64; k++ {
+						rs, err := d.decodeHuff(comp.ac)
+						if err != nil {
+							return nil, err
+						}
+						r, size := int(rs>>4), uint(rs&0x0f)
+						if size == 0 {
+							if r != 15 {
+								break // end of block
+							}
+							k += 15
+							continue
+						}
+						k += r
+						d.receive(size)
+					}
+				}
+			}
+		}
+	}
+
+	// leave out the padding of partial MCUs
+	w := (d.width*luma.h/hmax + 7) / 8
+	h := (d.height*luma.v/vmax + 7) / 8
+	return &image.Gray{Pix: pix, Stride: stride, Rect: image.Rect(0, 0, w, h)}, nil
+}
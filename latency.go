@@ -0,0 +1,98 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const latencySamples = 1024
+
+// LatencyStatus holds percentiles of the recent samples in seconds.
+type LatencyStatus struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+	Count   uint64  `json:"count"` // all samples since start
+	Sum     float64 `json:"sum"`
+}
+
+// sampleWindow keeps the last latencySamples durations in a ring.
+type sampleWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	sum     time.Duration
+}
+
+func newSampleWindow() *sampleWindow {
+	window := new(sampleWindow)
+
+	window.samples = make([]time.Duration, 0, latencySamples)
+
+	return window
+}
+
+func (window *sampleWindow) Add(d time.Duration) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	window.count++
+	window.sum += d
+	if len(window.samples) < latencySamples {
+		window.samples = append(window.samples, d)
+		return
+	}
+	window.samples[window.next] = d
+	window.next = (window.next + 1) % latencySamples
+}
+
+func (window *sampleWindow) Status() LatencyStatus {
+	window.mu.Lock()
+	sorted := make([]time.Duration, len(window.samples))
+	copy(sorted, window.samples)
+	count, sum := window.count, window.sum
+	window.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return LatencyStatus{Count: count, Sum: sum.Seconds()}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p float64) float64 {
+		i := int(p * float64(len(sorted)-1))
+		return sorted[i].Seconds()
+	}
+
+	return LatencyStatus{
+		Samples: len(sorted),
+		P50:     percentile(0.5),
+		P90:     percentile(0.9),
+		P99:     percentile(0.99),
+		Max:     sorted[len(sorted)-1].Seconds(),
+		Count:   count,
+		Sum:     sum.Seconds(),
+	}
+}
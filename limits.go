@@ -0,0 +1,196 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var viewerLimits = NewLimiter()
+
+type LimitStatus struct {
+	MaxClients      int  `json:"max_clients"`
+	MaxClientsPerIP int  `json:"max_clients_per_ip"`
+	MaxSubscribers  int  `json:"max_subscribers"`
+	Evict           bool `json:"evict"`
+	Clients         int  `json:"clients"`
+	Rejected        int  `json:"rejected"`
+	Evicted         int  `json:"evicted"`
+}
+
+// Limiter keeps track of viewers across all sources and enforces
+// global, per client address and per source connection limits.
+type Limiter struct {
+	mu             sync.Mutex
+	maxClients     int
+	maxPerIP       int
+	maxSubscribers int
+	evict          bool
+	retryAfter     time.Duration
+	perIP          map[string]int
+	perSource      map[string]int
+	viewers        map[*Subscriber]struct{}
+	rejected       int
+	evicted        int
+}
+
+type limitError struct {
+	limit string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s limit reached", e.limit)
+}
+
+func NewLimiter() *Limiter {
+	limiter := new(Limiter)
+
+	limiter.perIP = make(map[string]int)
+	limiter.perSource = make(map[string]int)
+	limiter.viewers = make(map[*Subscriber]struct{})
+
+	return limiter
+}
+
+// sourceLimit returns the per source limit, falling back to the default.
+func (limiter *Limiter) sourceLimit(pubSub *PubSub) int {
+	if pubSub.maxSubscribers > 0 {
+		return pubSub.maxSubscribers
+	}
+
+	return limiter.maxSubscribers
+}
+
+// exceeded returns the first limit a new viewer would break along with
+// a filter selecting the viewers that count against that limit.
+func (limiter *Limiter) exceeded(pubSub *PubSub, ip string) (string, func(*Subscriber) bool) {
+	if maxSubs := limiter.sourceLimit(pubSub); maxSubs > 0 && limiter.perSource[pubSub.id] >= maxSubs {
+		return "source", func(s *Subscriber) bool { return s.Source == pubSub.id }
+	}
+
+	if limiter.maxPerIP > 0 && limiter.perIP[ip] >= limiter.maxPerIP {
+		return "client", func(s *Subscriber) bool { return s.IP == ip }
+	}
+
+	if limiter.maxClients > 0 && len(limiter.viewers) >= limiter.maxClients {
+		return "global", func(s *Subscriber) bool { return true }
+	}
+
+	return "", nil
+}
+
+func (limiter *Limiter) oldestAnonymous(match func(*Subscriber) bool) *Subscriber {
+	var oldest *Subscriber
+
+	for s := range limiter.viewers {
+		if s.User != "" || !match(s) {
+			continue
+		}
+		if oldest == nil || s.ConnectTime.Before(oldest.ConnectTime) {
+			oldest = s
+		}
+	}
+
+	return oldest
+}
+
+func (limiter *Limiter) remove(s *Subscriber) {
+	if _, exists := limiter.viewers[s]; !exists {
+		return // already evicted
+	}
+
+	delete(limiter.viewers, s)
+
+	limiter.perIP[s.IP]--
+	if limiter.perIP[s.IP] <= 0 {
+		delete(limiter.perIP, s.IP)
+	}
+	limiter.perSource[s.Source]--
+}
+
+// Acquire registers a new viewer, evicting the oldest anonymous viewer
+// in the way if enabled, or returns the limit that was hit.
+func (limiter *Limiter) Acquire(pubSub *PubSub, s *Subscriber) error {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for {
+		limit, match := limiter.exceeded(pubSub, s.IP)
+		if limit == "" {
+			break
+		}
+
+		var victim *Subscriber
+		if limiter.evict {
+			victim = limiter.oldestAnonymous(match)
+		}
+		if victim == nil {
+			limiter.rejected++
+			return &limitError{limit: limit}
+		}
+
+		limiter.remove(victim)
+		limiter.evicted++
+		close(victim.evict)
+	}
+
+	limiter.viewers[s] = struct{}{}
+	limiter.perIP[s.IP]++
+	limiter.perSource[s.Source]++
+
+	return nil
+}
+
+func (limiter *Limiter) Release(s *Subscriber) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.remove(s)
+}
+
+// RetryAfter spreads reconnects of rejected clients over time.
+func (limiter *Limiter) RetryAfter() string {
+	retry := limiter.retryAfter
+	if retry <= 0 {
+		retry = time.Second
+	}
+	retry += time.Duration(rand.Int63n(int64(retry)))
+
+	return strconv.Itoa(int(retry.Seconds()))
+}
+
+func (limiter *Limiter) Status() LimitStatus {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return LimitStatus{
+		MaxClients:      limiter.maxClients,
+		MaxClientsPerIP: limiter.maxPerIP,
+		MaxSubscribers:  limiter.maxSubscribers,
+		Evict:           limiter.evict,
+		Clients:         len(limiter.viewers),
+		Rejected:        limiter.rejected,
+		Evicted:         limiter.evicted,
+	}
+}
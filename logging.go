@@ -0,0 +1,146 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var (
+	logChunker = slog.Default().With("subsystem", "chunker")
+	logPubSub  = slog.Default().With("subsystem", "pubsub")
+	logServer  = slog.Default().With("subsystem", "server")
+	logConfig  = slog.Default().With("subsystem", "config")
+
+	subscriberLevel = slog.LevelInfo
+)
+
+// levelHandler filters records below a per-subsystem level before
+// passing them to the shared output handler.
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, fmt.Errorf("invalid log level: %s", s)
+	}
+
+	return level, nil
+}
+
+// parseLevels reads a default level optionally followed by overrides,
+// for example "info,chunker=debug,pubsub=warn".
+func parseLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	def := slog.LevelInfo
+	levels := make(map[string]slog.Level)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 1 {
+			level, err := parseLevel(kv[0])
+			if err != nil {
+				return def, nil, err
+			}
+			def = level
+			continue
+		}
+
+		switch kv[0] {
+		case "chunker", "pubsub", "server", "config":
+		default:
+			return def, nil, fmt.Errorf("unknown log subsystem: %s", kv[0])
+		}
+		level, err := parseLevel(kv[1])
+		if err != nil {
+			return def, nil, err
+		}
+		levels[kv[0]] = level
+	}
+
+	return def, levels, nil
+}
+
+func setupLogging(w io.Writer, format, levelSpec, subLevel string) error {
+	var base slog.Handler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "text":
+		base = slog.NewTextHandler(w, opts)
+	case "json":
+		base = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	def, levels, err := parseLevels(levelSpec)
+	if err != nil {
+		return err
+	}
+
+	subscriberLevel, err = parseLevel(subLevel)
+	if err != nil {
+		return err
+	}
+
+	logger := func(subsystem string) *slog.Logger {
+		level, found := levels[subsystem]
+		if !found {
+			level = def
+		}
+		handler := &levelHandler{level: level, handler: base}
+		return slog.New(handler).With("subsystem", subsystem)
+	}
+
+	logChunker = logger("chunker")
+	logPubSub = logger("pubsub")
+	logServer = logger("server")
+	logConfig = logger("config")
+
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// metricsWriter renders the Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value with label name and value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.buf, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&mw.buf, " %g\n", value)
+}
+
+// latency writes a summary for every source, with the percentiles of
+// recent samples and the totals since start.
+func (mw *metricsWriter) latency(report StatusReport, name, help string, get func(SourceStatus) LatencyStatus) {
+	mw.header(name, "summary", help)
+	for _, source := range report.Sources {
+		l := get(source)
+		if l.Samples > 0 {
+			mw.sample(name, l.P50, "source", source.Path, "quantile", "0.5")
+			mw.sample(name, l.P90, "source", source.Path, "quantile", "0.9")
+			mw.sample(name, l.P99, "source", source.Path, "quantile", "0.99")
+			mw.sample(name, l.Max, "source", source.Path, "quantile", "1")
+		}
+		mw.sample(name+"_sum", l.Sum, "source", source.Path)
+		mw.sample(name+"_count", float64(l.Count), "source", source.Path)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	report := collectStatus(r)
+	mw := new(metricsWriter)
+
+	mw.header("mjpeg_proxy_clients", "gauge", "Number of connected viewers.")
+	mw.sample("mjpeg_proxy_clients", float64(report.Limits.Clients))
+	mw.header("mjpeg_proxy_rejected_total", "counter", "Viewers rejected by connection limits.")
+	mw.sample("mjpeg_proxy_rejected_total", float64(report.Limits.Rejected))
+	mw.header("mjpeg_proxy_evicted_total", "counter", "Viewers evicted by connection limits.")
+	mw.sample("mjpeg_proxy_evicted_total", float64(report.Limits.Evicted))
+
+	mw.header("mjpeg_proxy_source_up", "gauge", "Whether the source is streaming.")
+	for _, source := range report.Sources {
+		up := 0.0
+		if source.State == "started" {
+			up = 1
+		}
+		mw.sample("mjpeg_proxy_source_up", up, "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_stuck", "gauge", "Whether the source keeps sending the same image.")
+	for _, source := range report.Sources {
+		stuck := 0.0
+		if source.Stuck {
+			stuck = 1
+		}
+		mw.sample("mjpeg_proxy_source_stuck", stuck, "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_duplicates_total", "counter", "Duplicate frames dropped before publishing.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_duplicates_total", float64(source.Duplicates), "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_rejected_frames_total", "counter", "Invalid frames dropped before publishing.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_rejected_frames_total", float64(source.Rejected), "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_input_fps", "gauge", "Frames per second received from the source.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_input_fps", source.InputFps, "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_output_bits_per_second", "gauge", "Bits per second sent to viewers.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_output_bits_per_second", source.OutputBitrate, "source", source.Path)
+	}
+
+	mw.latency(report, "mjpeg_proxy_source_input_jitter_seconds",
+		"Change between consecutive frame intervals from the source.",
+		func(source SourceStatus) LatencyStatus { return source.InputJitter })
+	mw.latency(report, "mjpeg_proxy_source_queue_wait_seconds",
+		"Time from receiving a frame to a viewer taking it.",
+		func(source SourceStatus) LatencyStatus { return source.QueueWait })
+	mw.latency(report, "mjpeg_proxy_source_write_seconds",
+		"Time to write and flush a frame to a viewer.",
+		func(source SourceStatus) LatencyStatus { return source.WriteTime })
+
+	mw.header("mjpeg_proxy_source_subscribers", "gauge", "Number of viewers of the source.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_subscribers", float64(len(source.Subscribers)), "source", source.Path)
+	}
+
+	// per viewer detail is only in the status, client ports would make
+	// a new series for every connection
+	mw.header("mjpeg_proxy_source_subscriber_min_fps", "gauge", "Lowest frame rate chosen for a viewer, zero if none is limited.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_subscriber_min_fps", source.MinFps, "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_subscriber_max_write_latency_seconds", "gauge", "Highest smoothed time to write a frame to a viewer.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_subscriber_max_write_latency_seconds", source.MaxWriteLatency, "source", source.Path)
+	}
+
+	mw.header("mjpeg_proxy_source_dropped_frames_total", "counter", "Frames not sent to viewers.")
+	for _, source := range report.Sources {
+		mw.sample("mjpeg_proxy_source_dropped_frames_total", float64(source.Dropped), "source", source.Path)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := w.Write(mw.buf.Bytes())
+	if err != nil {
+		logServer.Debug("metrics write failed", "client", r.RemoteAddr, "error", err)
+	}
+}
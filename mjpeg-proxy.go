@@ -34,9 +34,11 @@ import (
 
 var (
 	clientHeader  string
+	proxyProtocol bool
 	frameTimeout  time.Duration
 	stopDelay     time.Duration
 	tcpSendBuffer int
+	proxySources  []*PubSub
 )
 
 type configSource struct {
@@ -46,18 +48,208 @@ type configSource struct {
 	Digest   bool
 	Path     string
 	Rate     float64
+	Allow    []string
+	Deny     []string
+
+	MaxSubscribers  int
+	Bandwidth       int
+	ClientBandwidth int
+	Delivery        string
+	QueueSize       int
+
+	Critical *bool // sources are critical for readiness unless disabled
+
+	AlwaysOn  bool
+	OnWindows []string // daily windows like "07:00-19:00" to stay connected
+	StopDelay string   // follow source after last client, like "30s"
+
+	Schedule     []string // viewing ranges like "Mon-Fri 08:00-18:00" or "Sat,Sun"
+	TimeZone     string
+	ClosedAction string // reject or placeholder outside the schedule
+	Placeholder  string // JPEG file shown outside the schedule
+
+	Mosaic *configMosaic // compose other sources instead of Source
+
+	History         string // keep frames for exports, like "10m"
+	HistoryInterval string // one kept frame per interval, default "1s"
+
+	Archive  *configArchive  // save snapshots to disk periodically
+	Dedup    *configDedup    // drop repeated frames
+	Validate *configValidate // drop corrupted frames
+
+	Transform *configTransform
+	Profiles  []configProfile
+
+	parent string // source path of a profile
+}
+
+// configProfile serves a transformed copy of the source on another path,
+// with the same viewer settings. The transform applies on top of the
+// source transform.
+type configProfile struct {
+	Path      string
+	Transform configTransform
 }
 
-func startSource(source, username, password, proxyUrl string, digest bool, rate float64) error {
-	chunker, err := NewChunker(proxyUrl, source, username, password, digest, rate)
+func startSource(conf configSource) error {
+	if conf.Mosaic != nil {
+		conf.Source = "mosaic:" + conf.Path
+	}
+	if conf.parent != "" {
+		conf.Source = "profile:" + conf.parent
+	}
+	chunker, err := NewChunker(conf.Path, conf.Source, conf.Username, conf.Password, conf.Digest, conf.Rate)
+	if err != nil {
+		return fmt.Errorf("chunker[%s]: create failed: %s", conf.Path, err)
+	}
+	if conf.Transform != nil {
+		chunker.transform, err = newTransform(*conf.Transform)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: transform: %s", conf.Path, err)
+		}
+	}
+	if conf.Dedup != nil {
+		chunker.dedup, err = newDedup(*conf.Dedup)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: %s", conf.Path, err)
+		}
+	}
+	if conf.Validate != nil {
+		chunker.validator, err = newFrameValidator(*conf.Validate)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: %s", conf.Path, err)
+		}
+	}
+	if conf.Mosaic != nil {
+		// mosaic frames do not pass through the chunk loop
+		if chunker.transform != nil || chunker.dedup != nil || chunker.validator != nil {
+			return fmt.Errorf("chunker[%s]: mosaic does not support transform, dedup or validate", conf.Path)
+		}
+		chunker.virtual, err = newMosaic(conf.Path, *conf.Mosaic)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: %s", conf.Path, err)
+		}
+	}
+	if conf.parent != "" {
+		derived := &Derived{parent: conf.parent, transform: chunker.transform}
+		chunker.transform = nil // applied by the derived source
+		chunker.virtual = derived
+	}
+	access, err := newAccessPolicy(conf.Allow, conf.Deny)
+	if err != nil {
+		return fmt.Errorf("pubsub[%s]: %s", conf.Path, err)
+	}
+	pubSub := NewPubSub(conf.Path, chunker)
+	pubSub.access = access
+	pubSub.maxSubscribers = conf.MaxSubscribers
+	if conf.Bandwidth == 0 {
+		conf.Bandwidth = sourceBandwidth
+	}
+	pubSub.bandwidth = newTokenBucket(conf.Bandwidth)
+	pubSub.clientKbps = conf.ClientBandwidth
+
+	if conf.Delivery == "" {
+		conf.Delivery = defaultDelivery
+	}
+	pubSub.delivery, err = parseDelivery(conf.Delivery)
+	if err != nil {
+		return fmt.Errorf("pubsub[%s]: %s", conf.Path, err)
+	}
+	pubSub.queueSize = conf.QueueSize
+	if pubSub.queueSize <= 0 {
+		pubSub.queueSize = defaultQueueSize
+	}
+	if pubSub.queueSize > maxQueueSize {
+		return fmt.Errorf("pubsub[%s]: queue size over %d", conf.Path, maxQueueSize)
+	}
+	pubSub.critical = conf.Critical == nil || *conf.Critical
+	pubSub.alwaysOn = conf.AlwaysOn
+	pubSub.windows, err = parseTimeWindows(conf.OnWindows)
+	if err != nil {
+		return fmt.Errorf("pubsub[%s]: %s", conf.Path, err)
+	}
+	pubSub.schedule, err = newSchedule(conf.Schedule, conf.TimeZone)
 	if err != nil {
-		return fmt.Errorf("chunker[%s]: create failed: %s", proxyUrl, err)
+		return fmt.Errorf("pubsub[%s]: %s", conf.Path, err)
+	}
+	switch conf.ClosedAction {
+	case "", scheduleReject:
+		pubSub.closedAction = scheduleReject
+	case schedulePlaceholder:
+		pubSub.closedAction = schedulePlaceholder
+		pubSub.placeholder, err = loadPlaceholder(conf.Placeholder)
+		if err != nil {
+			return fmt.Errorf("pubsub[%s]: placeholder: %s", conf.Path, err)
+		}
+	default:
+		return fmt.Errorf("pubsub[%s]: unknown closed action: %s", conf.Path, conf.ClosedAction)
+	}
+	if conf.History != "" {
+		keep, err := time.ParseDuration(conf.History)
+		if err != nil {
+			return fmt.Errorf("pubsub[%s]: invalid history: %s", conf.Path, conf.History)
+		}
+		interval := time.Second
+		if conf.HistoryInterval != "" {
+			interval, err = time.ParseDuration(conf.HistoryInterval)
+			if err != nil {
+				return fmt.Errorf("pubsub[%s]: invalid history interval: %s", conf.Path, conf.HistoryInterval)
+			}
+		}
+		pubSub.history = newFrameHistory(keep, interval)
+	}
+	if conf.StopDelay != "" {
+		pubSub.stopDelay, err = time.ParseDuration(conf.StopDelay)
+		if err != nil {
+			return fmt.Errorf("pubsub[%s]: invalid stop delay: %s", conf.Path, conf.StopDelay)
+		}
+	}
+	var archiver *Archiver
+	if conf.Archive != nil {
+		location := time.Local
+		if pubSub.schedule != nil {
+			location = pubSub.schedule.location
+		} else if conf.TimeZone != "" {
+			location, err = time.LoadLocation(conf.TimeZone)
+			if err != nil {
+				return fmt.Errorf("pubsub[%s]: invalid time zone: %s", conf.Path, conf.TimeZone)
+			}
+		}
+		archiver, err = newArchiver(pubSub, *conf.Archive, location)
+		if err != nil {
+			return fmt.Errorf("pubsub[%s]: %s", conf.Path, err)
+		}
 	}
-	pubSub := NewPubSub(proxyUrl, chunker)
 	pubSub.Start()
+	proxySources = append(proxySources, pubSub)
+	if archiver != nil {
+		go archiver.run()
+	}
+	if probeInterval > 0 {
+		go pubSub.probeLoop(probeInterval)
+	}
 
-	fmt.Printf("chunker[%s]: serving from %s\n", proxyUrl, source)
-	http.Handle(proxyUrl, pubSub)
+	logChunker.Info("serving", "source", conf.Path, "url", chunker.source.Redacted())
+	http.Handle(conf.Path, pubSub)
+
+	for _, profile := range conf.Profiles {
+		derived := conf
+		derived.Path = profile.Path
+		derived.Transform = &profile.Transform
+		derived.Profiles = nil
+		derived.Mosaic = nil
+		derived.AlwaysOn = false
+		derived.OnWindows = nil
+		derived.Archive = nil
+		derived.Dedup = nil
+		derived.Validate = nil
+		derived.parent = conf.Path
+
+		err = startSource(derived)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -70,7 +262,7 @@ func loadConfig(filename string) error {
 	defer func() {
 		err := file.Close()
 		if err != nil {
-			fmt.Printf("config: file close failed for %s: %s\n", file.Name(), err)
+			logConfig.Warn("file close failed", "file", file.Name(), "error", err)
 		}
 	}()
 
@@ -86,8 +278,14 @@ func loadConfig(filename string) error {
 		if exists[conf.Path] {
 			return fmt.Errorf("duplicate proxy path: %s", conf.Path)
 		}
+		for _, profile := range conf.Profiles {
+			if exists[profile.Path] || profile.Path == conf.Path {
+				return fmt.Errorf("duplicate proxy path: %s", profile.Path)
+			}
+			exists[profile.Path] = true
+		}
 
-		err = startSource(conf.Source, conf.Username, conf.Password, conf.Path, conf.Digest, conf.Rate)
+		err = startSource(conf)
 		if err != nil {
 			return err
 		}
@@ -95,10 +293,25 @@ func loadConfig(filename string) error {
 		exists[conf.Path] = true
 	}
 
+	for _, conf := range sources {
+		if conf.Mosaic == nil {
+			continue
+		}
+		for _, path := range conf.Mosaic.Sources {
+			if !exists[path] || path == conf.Path {
+				return fmt.Errorf("mosaic[%s]: unknown source: %s", conf.Path, path)
+			}
+		}
+	}
+
 	return nil
 }
 
 func connStateEvent(conn net.Conn, event http.ConnState) {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+
 	if event == http.StateActive && tcpSendBuffer > 0 {
 		switch c := conn.(type) {
 		case *net.TCPConn:
@@ -130,8 +343,11 @@ func listenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	if proxyProtocol {
+		listener = &proxyListener{listener}
+	}
 
-	fmt.Printf("server: starting on address %s\n", addr)
+	logServer.Info("starting", "address", addr)
 	server := &http.Server{
 		ConnState: connStateEvent,
 	}
@@ -143,6 +359,9 @@ func main() {
 	username := flag.String("username", "", "source uri username")
 	password := flag.String("password", "", "source uri password")
 	digest := flag.Bool("digest", false, "source uri uses digest authentication")
+	alwaysOn := flag.Bool("alwayson", false, "keep source connected without clients")
+	rotate := flag.Int("rotate", 0, "rotate source clockwise by 90, 180 or 270 degrees")
+	validate := flag.String("validate", validateOff, "drop corrupted frames (off, markers, header or decode)")
 	sources := flag.String("sources", "", "JSON configuration file to load sources from")
 	bind := flag.String("bind", ":8080", "proxy bind address")
 	path := flag.String("path", "/", "proxy serving path")
@@ -150,28 +369,127 @@ func main() {
 	maxprocs := flag.Int("maxprocs", 0, "limit number of CPUs used")
 	flag.DurationVar(&frameTimeout, "frametimeout", 60*time.Second, "limit waiting for next frame")
 	flag.DurationVar(&stopDelay, "stopduration", 60*time.Second, "follow source after last client")
+	flag.DurationVar(&headCacheTime, "headcache", 60*time.Second, "reuse source probe for HEAD requests")
+	flag.DurationVar(&readyMaxAge, "readymaxage", 3*time.Minute, "readiness limit for last frame or probe")
+	flag.DurationVar(&probeInterval, "probeinterval", 0, "probe idle sources in background, like 30m, 0 to disable and report idle sources as unknown to /readyz")
 	flag.IntVar(&tcpSendBuffer, "sendbuffer", 4096, "limit buffering of frames")
-	flag.StringVar(&clientHeader, "clientheader", "", "request header with client address")
+	flag.BoolVar(&adaptiveRate, "adaptive", true, "lower frame rate for viewers on slow links")
+	flag.StringVar(&defaultDelivery, "delivery", deliveryDrop, "frame delivery policy (drop, latest, queue or disconnect)")
+	flag.IntVar(&defaultQueueSize, "queuesize", 30, "frames buffered by queue and disconnect delivery policies")
+	flag.StringVar(&clientHeader, "clientheader", "", "request header with client address (X-Forwarded-For style or Forwarded)")
+	origins := flag.String("wsorigins", "", "other origins allowed to open WebSocket streams, * for any")
+	proxies := flag.String("trustedproxies", "127.0.0.0/8,::1", "networks allowed to set the client address")
+	flag.BoolVar(&proxyProtocol, "proxyprotocol", false, "require PROXY protocol header from trusted proxies")
+	logFormat := flag.String("logformat", "text", "log output format (text or json)")
+	logLevel := flag.String("loglevel", "info", "log level, optionally per subsystem (info,chunker=debug)")
+	subLevel := flag.String("subscriberlevel", "info", "log level for added and removed subscribers")
+	accessLogFile := flag.String("accesslog", "", "file to write viewer access log to")
+	accessLogFormat := flag.String("accesslogformat", "combined", "access log format (combined or json)")
+	allow := flag.String("allow", "", "networks allowed to view sources without authentication")
+	deny := flag.String("deny", "", "networks denied access to sources")
+	users := flag.String("users", "", "file with user:password lines for viewer authentication")
+	flag.StringVar(&authRealm, "realm", "mjpeg-proxy", "viewer authentication realm")
+	flag.IntVar(&viewerLimits.maxClients, "maxclients", 0, "limit number of viewers for all sources")
+	flag.IntVar(&viewerLimits.maxPerIP, "maxclientsperip", 0, "limit number of viewers from one client address")
+	flag.IntVar(&viewerLimits.maxSubscribers, "maxsubscribers", 0, "limit number of viewers per source")
+	flag.BoolVar(&viewerLimits.evict, "evict", false, "evict oldest anonymous viewer instead of rejecting new ones")
+	maxExports := flag.Int("maxexports", 2, "limit number of GIF and timelapse exports running at once, 0 for no limit")
+	bandwidth := flag.Int("bandwidth", 0, "limit output kbit/s for all viewers")
+	flag.IntVar(&sourceBandwidth, "sourcebandwidth", 0, "limit output kbit/s per source")
+	flag.IntVar(&clientBandwidth, "clientbandwidth", 0, "limit output kbit/s per viewer")
+	flag.DurationVar(&viewerLimits.retryAfter, "retryafter", 10*time.Second, "minimum Retry-After for rejected viewers")
 	flag.Parse()
 
+	err := setupLogging(os.Stdout, *logFormat, *logLevel, *subLevel)
+	if err != nil {
+		fmt.Println("config:", err)
+		os.Exit(1)
+	}
+
 	if *maxprocs > 0 {
 		runtime.GOMAXPROCS(*maxprocs)
 	}
 
-	var err error
+	trustedProxies, err = parseCIDRList(*proxies)
+	if err != nil {
+		logConfig.Error("invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
+
+	for _, origin := range strings.Split(*origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			wsOrigins = append(wsOrigins, strings.TrimRight(origin, "/"))
+		}
+	}
+
+	globalBandwidth = newTokenBucket(*bandwidth)
+	if *maxExports > 0 {
+		exportSlots = make(chan struct{}, *maxExports)
+	}
+
+	globalAllow, err = parseCIDRList(*allow)
+	if err != nil {
+		logConfig.Error("invalid allow list", "error", err)
+		os.Exit(1)
+	}
+	globalDeny, err = parseCIDRList(*deny)
+	if err != nil {
+		logConfig.Error("invalid deny list", "error", err)
+		os.Exit(1)
+	}
+	if *users != "" {
+		viewerUsers, err = loadUsers(*users)
+		if err != nil {
+			logConfig.Error("failed to load users", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *accessLogFile != "" {
+		accessLog, err = NewAccessLog(*accessLogFile, *accessLogFormat)
+		if err != nil {
+			logConfig.Error("failed to open access log", "error", err)
+			os.Exit(1)
+		}
+		accessLog.ReopenOnSignal()
+	}
+
 	if *sources != "" {
 		err = loadConfig(*sources)
 	} else {
-		err = startSource(*source, *username, *password, *path, *digest, *rate)
+		err = startSource(configSource{
+			Source:    *source,
+			Username:  *username,
+			Password:  *password,
+			Digest:    *digest,
+			Path:      *path,
+			Rate:      *rate,
+			AlwaysOn:  *alwaysOn,
+			Transform: &configTransform{Rotate: *rotate},
+			Validate:  &configValidate{Level: *validate},
+		})
 	}
 	if err != nil {
-		fmt.Println("config:", err)
+		logConfig.Error("failed to load sources", "error", err)
 		os.Exit(1)
 	}
 
+	http.Handle("/events", restricted(eventBus))
+	http.Handle("/status", restricted(http.HandlerFunc(statusHandler)))
+	http.Handle("/status.html", restricted(http.HandlerFunc(statusHTMLHandler)))
+	http.Handle("/metrics", restricted(http.HandlerFunc(metricsHandler)))
+	http.HandleFunc("/healthz", healthHandler) // open for orchestrator probes
+	http.HandleFunc("/readyz", readyHandler)
+	http.Handle("/assets/", assetsHandler())
+	http.Handle("/index.html", restricted(http.HandlerFunc(indexHandler)))
+	if findSource("/") == nil {
+		http.Handle("/", restricted(http.HandlerFunc(indexHandler)))
+	}
+
 	err = listenAndServe(*bind)
 	if err != nil {
-		fmt.Println("server:", err)
+		logServer.Error("failed to serve", "error", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,311 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mosaicStale      = 5 * time.Second
+	mosaicLabelScale = 2
+)
+
+type configMosaic struct {
+	Sources     []string // paths of the sources shown in the tiles
+	Labels      []string // optional tile labels in the same order
+	Columns     int
+	TileWidth   int
+	TileHeight  int
+	Fps         float64
+	Quality     int
+	Placeholder string // JPEG file shown for tiles without a signal
+}
+
+// Mosaic composes the latest frames of other sources into one grid.
+// It runs in place of the upstream connection of a Chunker.
+type Mosaic struct {
+	id          string
+	inputs      []string
+	labels      []string
+	columns     int
+	rows        int
+	tile        image.Point
+	interval    time.Duration
+	quality     int
+	placeholder *image.RGBA
+}
+
+// mosaicTile holds the latest frame of one input. The scaled image is
+// only used by the composing goroutine.
+type mosaicTile struct {
+	mu     sync.Mutex
+	frame  *Frame
+	scaled *image.RGBA
+	seq    uint64
+}
+
+func newMosaic(id string, conf configMosaic) (*Mosaic, error) {
+	if len(conf.Sources) == 0 {
+		return nil, fmt.Errorf("mosaic has no sources")
+	}
+	if conf.Quality < 0 || conf.Quality > 100 {
+		return nil, fmt.Errorf("invalid mosaic quality: %d", conf.Quality)
+	}
+
+	mosaic := new(Mosaic)
+
+	mosaic.id = id
+	mosaic.inputs = conf.Sources
+	mosaic.labels = conf.Labels
+	mosaic.columns = conf.Columns
+	if mosaic.columns <= 0 {
+		mosaic.columns = int(math.Ceil(math.Sqrt(float64(len(conf.Sources)))))
+	}
+	mosaic.rows = (len(conf.Sources) + mosaic.columns - 1) / mosaic.columns
+	mosaic.tile = image.Pt(conf.TileWidth, conf.TileHeight)
+	if mosaic.tile.X <= 0 || mosaic.tile.Y <= 0 {
+		mosaic.tile = image.Pt(320, 240)
+	}
+	fps := conf.Fps
+	if fps <= 0 {
+		fps = 2
+	}
+	mosaic.interval = frameInterval(fps)
+	mosaic.quality = conf.Quality
+	if mosaic.quality == 0 {
+		mosaic.quality = jpeg.DefaultQuality
+	}
+
+	var err error
+	mosaic.placeholder, err = mosaic.loadPlaceholder(conf.Placeholder)
+	if err != nil {
+		return nil, err
+	}
+
+	return mosaic, nil
+}
+
+func (mosaic *Mosaic) loadPlaceholder(filename string) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rectangle{Max: mosaic.tile})
+
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		src, err := decodeJPEG(data)
+		if err != nil {
+			return nil, fmt.Errorf("placeholder %s: %s", filename, err)
+		}
+		scaleImage(img, src)
+		return img, nil
+	}
+
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x30, 0x30, 0x30, 0xff}), image.Point{}, draw.Src)
+	text := "NO SIGNAL"
+	size := textSize(text, mosaicLabelScale)
+	pt := image.Pt((mosaic.tile.X-size.X)/2, (mosaic.tile.Y-size.Y)/2)
+	drawText(img, pt, text, mosaicLabelScale, color.RGBA{0xa0, 0xa0, 0xa0, 0xff})
+
+	return img, nil
+}
+
+func (tile *mosaicTile) set(frame *Frame) {
+	tile.mu.Lock()
+	defer tile.mu.Unlock()
+
+	if tile.frame != nil {
+		tile.frame.Release()
+	}
+	tile.frame = frame
+}
+
+// latest returns a reference to the current frame, or nil.
+func (tile *mosaicTile) latest() *Frame {
+	tile.mu.Lock()
+	defer tile.mu.Unlock()
+
+	if tile.frame != nil {
+		tile.frame.Retain()
+	}
+	return tile.frame
+}
+
+// compose draws all tiles and encodes the grid into a new frame.
+func (mosaic *Mosaic) compose(tiles []*mosaicTile) (*Frame, error) {
+	out := image.NewRGBA(image.Rect(0, 0,
+		mosaic.columns*mosaic.tile.X, mosaic.rows*mosaic.tile.Y))
+
+	for i, tile := range tiles {
+		origin := image.Pt(i%mosaic.columns*mosaic.tile.X, i/mosaic.columns*mosaic.tile.Y)
+		rect := image.Rectangle{Min: origin, Max: origin.Add(mosaic.tile)}
+
+		var img image.Image = mosaic.placeholder
+		frame := tile.latest()
+		if frame != nil && time.Since(frame.Time) < mosaicStale {
+			if tile.scaled == nil || frame.Seq != tile.seq {
+				src, err := decodeJPEG(frame.Data)
+				if err == nil {
+					if tile.scaled == nil {
+						tile.scaled = image.NewRGBA(image.Rectangle{Max: mosaic.tile})
+					}
+					scaleImage(tile.scaled, src)
+					tile.seq = frame.Seq
+				} else {
+					tile.scaled = nil
+				}
+			}
+			if tile.scaled != nil {
+				img = tile.scaled
+			}
+		}
+		if frame != nil {
+			frame.Release()
+		}
+		draw.Draw(out, rect, img, image.Point{}, draw.Src)
+
+		if i < len(mosaic.labels) && mosaic.labels[i] != "" {
+			drawLabel(out, rect, mosaic.labels[i])
+		}
+	}
+
+	frame := newFrame(0)
+	buf := bytes.NewBuffer(frame.Data)
+	err := jpeg.Encode(buf, out, &jpeg.Options{Quality: mosaic.quality})
+	frame.Data = buf.Bytes()
+	if err != nil {
+		frame.Release()
+		return nil, err
+	}
+	frame.Time = time.Now()
+	frame.Width = out.Rect.Dx()
+	frame.Height = out.Rect.Dy()
+
+	return frame, nil
+}
+
+// drawLabel writes the label in the bottom left corner of the tile on
+// a darkened band.
+func drawLabel(img *image.RGBA, rect image.Rectangle, label string) {
+	size := textSize(label, mosaicLabelScale)
+	pad := mosaicLabelScale * 2
+	band := image.Rect(rect.Min.X, rect.Max.Y-size.Y-2*pad,
+		rect.Min.X+size.X+2*pad, rect.Max.Y).Intersect(rect)
+
+	for y := band.Min.Y; y < band.Max.Y; y++ {
+		for x := band.Min.X; x < band.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{c.R / 3, c.G / 3, c.B / 3, 0xff})
+		}
+	}
+
+	drawText(img, image.Pt(band.Min.X+pad, band.Min.Y+pad), label,
+		mosaicLabelScale, color.RGBA{0xff, 0xff, 0xff, 0xff})
+}
+
+// scaleImage fits src into dst keeping the aspect ratio, using nearest
+// neighbour sampling. Unused borders are black.
+func scaleImage(dst *image.RGBA, src image.Image) {
+	draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	sb := src.Bounds()
+	db := dst.Bounds()
+	if sb.Empty() || db.Empty() {
+		return
+	}
+
+	w, h := db.Dx(), sb.Dy()*db.Dx()/sb.Dx()
+	if h > db.Dy() {
+		w, h = sb.Dx()*db.Dy()/sb.Dy(), db.Dy()
+	}
+	fit := image.Rect(0, 0, w, h).Add(db.Min).Add(image.Pt((db.Dx()-w)/2, (db.Dy()-h)/2))
+
+	ycc, _ := src.(*image.YCbCr)
+	for y := fit.Min.Y; y < fit.Max.Y; y++ {
+		sy := sb.Min.Y + (y-fit.Min.Y)*sb.Dy()/fit.Dy()
+		for x := fit.Min.X; x < fit.Max.X; x++ {
+			sx := sb.Min.X + (x-fit.Min.X)*sb.Dx()/fit.Dx()
+			dst.SetRGBA(x, y, rgbaAt(src, ycc, sx, sy))
+		}
+	}
+}
+
+// run publishes composed frames until the chunker is stopped.
+func (mosaic *Mosaic) sources() []string {
+	return mosaic.inputs
+}
+
+func (mosaic *Mosaic) run(chunker *Chunker, pubChan chan *Frame) {
+	stop := chunker.stop
+
+	tiles := make([]*mosaicTile, len(mosaic.inputs))
+	var wg sync.WaitGroup
+	for i, path := range mosaic.inputs {
+		tiles[i] = new(mosaicTile)
+		wg.Add(1)
+		go func(path string, tile *mosaicTile) {
+			defer wg.Done()
+			followSource(findSource(path), "mosaic:"+mosaic.id, stop, tile.set)
+		}(path, tiles[i])
+	}
+
+	ticker := time.NewTicker(mosaic.interval)
+
+ComposeLoop:
+	for {
+		frame, err := mosaic.compose(tiles)
+		if err != nil {
+			logChunker.Warn("mosaic encode failed", "source", chunker.id, "error", err)
+		} else {
+			chunker.frameReceived(len(frame.Data))
+			chunker.seq++
+			frame.Seq = chunker.seq
+
+			select {
+			case pubChan <- frame:
+			case <-stop:
+				frame.Release()
+				break ComposeLoop
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			break ComposeLoop
+		}
+	}
+
+	ticker.Stop()
+	wg.Wait()
+	for _, tile := range tiles {
+		tile.set(nil)
+	}
+}
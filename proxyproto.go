@@ -0,0 +1,203 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* PROXY protocol headers look like this:
+
+   v1: PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+   v2: \r\n\r\n\x00\r\nQUIT\n, version/command, family, length, addresses
+*/
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+}
+
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (listener *proxyListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// init reads the header on first use, outside of the accept loop.
+func (conn *proxyConn) init() {
+	conn.once.Do(func() {
+		if !trustedPeer(conn.Conn.RemoteAddr().String()) {
+			conn.err = fmt.Errorf("untrusted peer: %s", conn.Conn.RemoteAddr())
+		} else {
+			conn.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+			conn.remote, conn.err = readProxyHeader(conn.reader)
+			conn.Conn.SetReadDeadline(time.Time{})
+		}
+
+		if conn.err != nil {
+			logServer.Warn("proxy protocol failed",
+				"client", conn.Conn.RemoteAddr().String(), "error", conn.err)
+			conn.Conn.Close()
+		}
+	})
+}
+
+func (conn *proxyConn) Read(b []byte) (int, error) {
+	conn.init()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+
+	return conn.reader.Read(b)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	conn.init()
+	if conn.remote != nil {
+		return conn.remote
+	}
+
+	return conn.Conn.RemoteAddr()
+}
+
+// readProxyHeader returns the client address from the header, or nil
+// when the proxy sent no address information.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	sig, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+
+	sig, err = reader.Peek(6)
+	if err == nil && string(sig) == "PROXY " {
+		return readProxyV1(reader)
+	}
+
+	return nil, errors.New("missing proxy protocol header")
+}
+
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy v1 address: %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy v2 version: %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0: // LOCAL, health checks from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported proxy v2 command: %d", verCmd&0xf)
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short proxy v2 ipv4 address")
+		}
+		ip := net.IP(payload[0:4])
+		port := binary.BigEndian.Uint16(payload[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short proxy v2 ipv6 address")
+		}
+		ip := net.IP(payload[0:16])
+		port := binary.BigEndian.Uint16(payload[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+}
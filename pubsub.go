@@ -21,38 +21,100 @@ package main
 
 import (
 	"fmt"
-	"mime/multipart"
 	"net/http"
-	"net/textproto"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Subscriber struct {
+	dropped      uint64 // first for 64-bit alignment
+	interval     int64
+	latency      int64
 	RemoteAddr   string
-	ChunkChannel chan []byte
+	IP           string
+	Source       string
+	User         string
+	ConnectTime  time.Time
+	Fps          float64
+	Delivery     string
+	ChunkChannel chan *Frame
+	evict        chan struct{}
+	lagging      bool
+	total        *uint64 // dropped frames of the source
 }
 
 type PubSub struct {
-	id          string
-	chunker     *Chunker
-	pubChan     chan []byte
-	subChan     chan *Subscriber
-	unsubChan   chan *Subscriber
-	subscribers map[*Subscriber]struct{}
-	stopTimer   *time.Timer
+	dropped        uint64 // frames not sent to viewers, never decreases
+	id             string
+	chunker        *Chunker
+	pubChan        chan *Frame
+	subChan        chan *Subscriber
+	unsubChan      chan *Subscriber
+	statusChan     chan chan SourceStatus
+	snapChan       chan chan *Frame
+	historyChan    chan chan []*Frame
+	subscribers    map[*Subscriber]struct{}
+	stopTimer      *time.Timer
+	output         *rateMeter
+	queueWait      *sampleWindow
+	writeTime      *sampleWindow
+	access         *accessPolicy
+	maxSubscribers int
+	bandwidth      *tokenBucket
+	clientKbps     int
+	delivery       string
+	queueSize      int
+	probeCache     probeCache
+	critical       bool
+	alwaysOn       bool
+	windows        []timeWindow
+	stopDelay      time.Duration
+	lastFrame      *Frame // most recent frame, owned by the loop
+	schedule       *schedule
+	closedAction   string
+	placeholder    []byte
+	history        *frameHistory
 }
 
 func NewSubscriber(client string) *Subscriber {
 	sub := new(Subscriber)
 
 	sub.RemoteAddr = client
-	sub.ChunkChannel = make(chan []byte)
+	sub.IP = clientHost(client)
+	sub.ConnectTime = time.Now()
+	sub.ChunkChannel = make(chan *Frame)
+	sub.evict = make(chan struct{})
 
 	return sub
 }
 
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscriber) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+	if s.total != nil {
+		atomic.AddUint64(s.total, 1)
+	}
+}
+
+// Interval returns the current frame interval, zero if not limited.
+func (s *Subscriber) Interval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.interval))
+}
+
+// WriteLatency returns the smoothed time to write and flush a frame.
+func (s *Subscriber) WriteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+func (s *Subscriber) setInterval(interval, latency time.Duration) {
+	atomic.StoreInt64(&s.interval, int64(interval))
+	atomic.StoreInt64(&s.latency, int64(latency))
+}
+
 func NewPubSub(id string, chunker *Chunker) *PubSub {
 	pubSub := new(PubSub)
 
@@ -60,9 +122,17 @@ func NewPubSub(id string, chunker *Chunker) *PubSub {
 	pubSub.chunker = chunker
 	pubSub.subChan = make(chan *Subscriber)
 	pubSub.unsubChan = make(chan *Subscriber)
+	pubSub.statusChan = make(chan chan SourceStatus)
+	pubSub.snapChan = make(chan chan *Frame)
+	pubSub.historyChan = make(chan chan []*Frame)
 	pubSub.subscribers = make(map[*Subscriber]struct{})
 	pubSub.stopTimer = time.NewTimer(0)
 	<-pubSub.stopTimer.C
+	pubSub.output = newRateMeter()
+	pubSub.queueWait = newSampleWindow()
+	pubSub.writeTime = newSampleWindow()
+	pubSub.access = new(accessPolicy)
+	pubSub.stopDelay = stopDelay
 
 	return pubSub
 }
@@ -72,6 +142,7 @@ func (pubSub *PubSub) Start() {
 }
 
 func (pubSub *PubSub) Subscribe(s *Subscriber) {
+	s.total = &pubSub.dropped
 	pubSub.subChan <- s
 }
 
@@ -79,12 +150,29 @@ func (pubSub *PubSub) Unsubscribe(s *Subscriber) {
 	pubSub.unsubChan <- s
 }
 
+func (pubSub *PubSub) publish(ev Event) {
+	ev.Source = pubSub.id
+	ev.subsystem = "pubsub"
+	eventBus.Publish(ev)
+}
+
 func (pubSub *PubSub) loop() {
+	// keep the source connected without subscribers if configured
+	var keepAlive <-chan time.Time
+	if pubSub.alwaysOn || len(pubSub.windows) > 0 || pubSub.schedule != nil {
+		ticker := time.NewTicker(keepAliveRetry)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+		pubSub.keepAlive()
+	}
+
 	for {
 		select {
-		case data, ok := <-pubSub.pubChan:
+		case frame, ok := <-pubSub.pubChan:
 			if ok {
-				pubSub.doPublish(data)
+				pubSub.doPublish(frame)
+				pubSub.history.Add(frame)
+				pubSub.cacheFrame(frame)
 			} else {
 				pubSub.stopChunker()
 				pubSub.stopSubscribers()
@@ -96,33 +184,85 @@ func (pubSub *PubSub) loop() {
 		case sub := <-pubSub.unsubChan:
 			pubSub.doUnsubscribe(sub)
 
+		case reply := <-pubSub.statusChan:
+			reply <- pubSub.doStatus()
+
+		case reply := <-pubSub.snapChan:
+			reply <- pubSub.cachedFrame()
+
+		case reply := <-pubSub.historyChan:
+			reply <- pubSub.history.Frames()
+
 		case <-pubSub.stopTimer.C:
-			if len(pubSub.subscribers) == 0 {
+			if len(pubSub.subscribers) == 0 && !pubSub.keepConnected(time.Now()) {
 				pubSub.stopChunker()
 			}
+
+		case <-keepAlive:
+			pubSub.keepAlive()
 		}
 	}
 }
 
-func (pubSub *PubSub) doPublish(data []byte) {
+func (pubSub *PubSub) doPublish(frame *Frame) {
 	for s := range pubSub.subscribers {
-		select {
-		case s.ChunkChannel <- data: // try to send
-		default: // or skip this frame
+		frame.Retain()
+		if !s.deliver(frame) {
+			pubSub.disconnectSubscriber(s)
+		}
+	}
+}
+
+// cacheFrame keeps the frame reference as the most recent frame.
+func (pubSub *PubSub) cacheFrame(frame *Frame) {
+	if pubSub.lastFrame != nil {
+		pubSub.lastFrame.Release()
+	}
+	pubSub.lastFrame = frame
+}
+
+// disconnectSubscriber drops the queued frames so the client stops
+// right away instead of working through a stale backlog.
+func (pubSub *PubSub) disconnectSubscriber(s *Subscriber) {
+DrainLoop:
+	for {
+		select { // the viewer may take the last frame first
+		case frame := <-s.ChunkChannel:
+			frame.Release()
+		default:
+			break DrainLoop
 		}
 	}
+
+	s.lagging = true
+	close(s.ChunkChannel)
+	pubSub.doUnsubscribe(s)
 }
 
 func (pubSub *PubSub) doSubscribe(s *Subscriber) {
 	pubSub.subscribers[s] = struct{}{}
 
-	fmt.Printf("pubsub[%s]: added subscriber %s (total=%d)\n",
-		pubSub.id, s.RemoteAddr, len(pubSub.subscribers))
+	pubSub.publish(Event{
+		Type:        EventSubscriber,
+		Client:      s.RemoteAddr,
+		Subscribers: len(pubSub.subscribers),
+		Message:     "added subscriber",
+	})
+
+	// a connected source has a current frame to start with, queued
+	// only where the channel can hold it before the viewer is reading
+	if pubSub.pubChan != nil && pubSub.lastFrame != nil && cap(s.ChunkChannel) > 0 {
+		pubSub.lastFrame.Retain()
+		s.deliver(pubSub.lastFrame)
+	}
 
 	if pubSub.pubChan == nil {
 		if err := pubSub.startChunker(); err != nil {
-			fmt.Printf("pubsub[%s]: failed to start chunker: %s\n",
-				pubSub.id, err)
+			pubSub.publish(Event{
+				Type:    EventError,
+				Error:   err.Error(),
+				Message: "failed to start chunker",
+			})
 			pubSub.stopSubscribers()
 		}
 	}
@@ -142,8 +282,13 @@ func (pubSub *PubSub) doUnsubscribe(s *Subscriber) {
 
 	delete(pubSub.subscribers, s)
 
-	fmt.Printf("pubsub[%s]: removed subscriber %s (total=%d)\n",
-		pubSub.id, s.RemoteAddr, len(pubSub.subscribers))
+	pubSub.publish(Event{
+		Type:        EventSubscriber,
+		Client:      s.RemoteAddr,
+		Subscribers: len(pubSub.subscribers),
+		Message:     "removed subscriber",
+		duration:    time.Since(s.ConnectTime),
+	})
 
 	if len(pubSub.subscribers) == 0 {
 		if !pubSub.stopTimer.Stop() {
@@ -152,7 +297,7 @@ func (pubSub *PubSub) doUnsubscribe(s *Subscriber) {
 			default:
 			}
 		}
-		pubSub.stopTimer.Reset(stopDelay)
+		pubSub.stopTimer.Reset(pubSub.stopDelay)
 	}
 }
 
@@ -166,7 +311,7 @@ func (pubSub *PubSub) startChunker() error {
 		return err
 	}
 
-	pubSub.pubChan = make(chan []byte)
+	pubSub.pubChan = make(chan *Frame)
 	go pubSub.chunker.Start(pubSub.pubChan)
 
 	return nil
@@ -180,64 +325,209 @@ func (pubSub *PubSub) stopChunker() {
 	pubSub.pubChan = nil
 }
 
-func clientAddress(r *http.Request) string {
-	client := r.RemoteAddr
-
-	if clientHeader != "" {
-		header := r.Header.Get(clientHeader)
-		hosts := strings.Split(header, ",")
-		if hosts[0] != "" {
-			client = hosts[0]
-		}
+func parseFrameRate(fps string) float64 {
+	f, err := strconv.ParseFloat(fps, 64)
+	if err != nil || f <= 0 {
+		return 0
 	}
 
-	return client
+	return f
 }
 
-func parseSendInterval(fps string) time.Duration {
-	f, err := strconv.ParseFloat(fps, 64)
-	if err != nil {
+func frameInterval(fps float64) time.Duration {
+	if fps <= 0 {
 		return 0
 	}
 
-	return time.Duration(1000.0/f) * time.Millisecond
+	return time.Duration(1000.0/fps) * time.Millisecond
+}
+
+// requestDelivery returns the delivery policy and queue size from the
+// query, falling back to the source settings.
+func (pubSub *PubSub) requestDelivery(r *http.Request) (string, int, error) {
+	delivery := pubSub.delivery
+	if r.FormValue("delivery") != "" {
+		var err error
+		delivery, err = parseDelivery(r.FormValue("delivery"))
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	queueSize := pubSub.queueSize
+	if r.FormValue("queue") != "" {
+		var err error
+		queueSize, err = parseQueueSize(r.FormValue("queue"))
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	return delivery, queueSize, nil
 }
 
 func (pubSub *PubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := newAccessSession()
+	defer accessLog.Log(r, session)
+
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		session.status = http.StatusMethodNotAllowed
+		session.reason = reasonBadRequest
 		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
 		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 
+	user, status := pubSub.access.checkAccess(w, r)
+	if status != http.StatusOK {
+		session.status = status
+		session.reason = reasonDenied
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	session.user = user
+
+	// snapshots and exports take frames, so HEAD only reports health
+	action := r.URL.Query().Get("action")
+	if r.Method == http.MethodHead && action != "" && action != "view" {
+		if !pubSub.schedule.Open(time.Now()) {
+			pubSub.serveClosed(w, r, session)
+			return
+		}
+		switch action {
+		case "snapshot":
+			pubSub.serveHead(w, session, "image/jpeg")
+		case "gif":
+			pubSub.serveHead(w, session, "image/gif")
+		default:
+			pubSub.serveHead(w, session, "")
+		}
+		return
+	}
+
+	switch action {
+	case "":
+	case "view":
+		pubSub.serveViewer(w, r, session)
+		return
+	case "snapshot":
+		pubSub.serveSnapshot(w, r, session)
+		return
+	case "gif", "timelapse":
+		pubSub.serveExport(w, r, session, action)
+		return
+	default:
+		session.status = http.StatusBadRequest
+		session.reason = reasonBadRequest
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	// keep viewers and the source idle outside the schedule
+	if !pubSub.schedule.Open(time.Now()) {
+		pubSub.serveClosed(w, r, session)
+		return
+	}
+
+	// answer monitoring checks without waking up the source
+	if r.Method == http.MethodHead {
+		pubSub.serveHead(w, session, "")
+		return
+	}
+
 	// allow client to lower the frame rate
 	err := r.ParseForm()
 	if err != nil {
+		session.status = http.StatusBadRequest
+		session.reason = reasonBadRequest
 		http.Error(w, "Invalid query", http.StatusBadRequest)
 		return
 	}
-	sendInterval := parseSendInterval(r.FormValue("fps"))
+	fps := parseFrameRate(r.FormValue("fps"))
+	sendInterval := frameInterval(fps)
+
+	// allow client to choose how frames are queued
+	delivery, queueSize, err := pubSub.requestDelivery(r)
+	if err != nil {
+		session.status = http.StatusBadRequest
+		session.reason = reasonBadRequest
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// prepare response for flushing
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		fmt.Printf("server[%s]: client %s could not be flushed\n",
-			pubSub.id, r.RemoteAddr)
+		session.reason = reasonWriteFailed
+		logServer.Warn("client could not be flushed",
+			"source", pubSub.id, "client", r.RemoteAddr)
 		return
 	}
 
-	// subscribe to new chunks
+	// reject bad websocket handshakes before taking a viewer slot
+	if isWebSocketRequest(r) {
+		status, err := checkWebSocket(w, r)
+		if err != nil {
+			session.status = status
+			session.reason = reasonBadRequest
+			if status == http.StatusForbidden {
+				session.reason = reasonDenied
+			}
+			logServer.Debug("websocket handshake rejected",
+				"source", pubSub.id, "client", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	// check connection limits
 	sub := NewSubscriber(clientAddress(r))
+	sub.Source = pubSub.id
+	sub.User = user
+	sub.Fps = fps
+	sub.setInterval(sendInterval, 0)
+	sub.setDelivery(delivery, queueSize)
+	err = viewerLimits.Acquire(pubSub, sub)
+	if err != nil {
+		session.status = http.StatusServiceUnavailable
+		session.reason = reasonOverLimit
+		logServer.Info("viewer rejected",
+			"source", pubSub.id, "client", sub.RemoteAddr, "error", err)
+		w.Header().Set("Retry-After", viewerLimits.RetryAfter())
+		http.Error(w, "Too many viewers", http.StatusServiceUnavailable)
+		return
+	}
+	defer viewerLimits.Release(sub)
+
+	clientKbps := clientBandwidth
+	if pubSub.clientKbps > 0 {
+		clientKbps = pubSub.clientKbps
+	}
+	bandwidth := newTokenBucket(clientKbps)
+	control := newRateController(sendInterval)
+
+	// subscribe to new chunks
 	pubSub.Subscribe(sub)
-	defer pubSub.Unsubscribe(sub)
+	defer func() {
+		pubSub.Unsubscribe(sub)
+		sub.releaseQueued()
+	}()
 
-	mw := multipart.NewWriter(w)
-	contentType := fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mw.Boundary())
+	if isWebSocketRequest(r) {
+		pubSub.serveWebSocket(w, r, sub, session, bandwidth, control)
+		return
+	}
 
-	mimeHeader := make(textproto.MIMEHeader)
-	mimeHeader.Set("Content-Type", "image/jpeg")
+	cw := &countingWriter{w: w}
+	defer func() {
+		session.bytes = cw.n
+	}()
 
-	var data []byte
+	boundary := randomBoundary()
+	pw := newPartWriter(cw, boundary)
+	contentType := fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", boundary)
+
+	var frame *Frame
 	var chunkOk, headersSent bool
 	var lastSendTime time.Time
 
@@ -245,11 +535,23 @@ LOOP:
 	for {
 		// wait for next chunk
 		select {
-		case data, chunkOk = <-sub.ChunkChannel:
+		case frame, chunkOk = <-sub.ChunkChannel:
 			if !chunkOk {
+				session.reason = reasonSourceEnded
+				if sub.lagging {
+					session.reason = reasonLagging
+					logServer.Info("viewer too slow",
+						"source", pubSub.id, "client", sub.RemoteAddr)
+				}
 				break LOOP
 			}
+			pubSub.queueWait.Add(time.Since(frame.Time))
 		case <-r.Context().Done():
+			session.reason = reasonClientClosed
+			break LOOP
+		case <-sub.evict:
+			session.reason = reasonEvicted
+			logServer.Info("viewer evicted", "source", pubSub.id, "client", sub.RemoteAddr)
 			break LOOP
 		}
 
@@ -258,37 +560,68 @@ LOOP:
 			header := w.Header()
 			header.Add("Content-Type", contentType)
 			w.WriteHeader(http.StatusOK)
+			session.status = http.StatusOK
 			headersSent = true
-		} else if sendInterval > 0 && time.Now().Sub(lastSendTime) < sendInterval {
+		} else if interval := sub.Interval(); interval > 0 && time.Now().Sub(lastSendTime) < interval {
+			frame.Release()
+			sub.drop()
+			session.skipped++
 			continue // skip this chunk
 		}
 
-		lastSendTime = time.Now()
-		mimeHeader.Set("Content-Length", fmt.Sprintf("%d", len(data)))
-		part, err := mw.CreatePart(mimeHeader)
-		if err != nil {
-			fmt.Printf("server[%s]: part create failed: %s\n", pubSub.id, err)
-			return
+		// drop whole frames when over the bandwidth budget
+		size := len(frame.Data)
+		if !takeFrame(size, bandwidth, pubSub.bandwidth, globalBandwidth) {
+			frame.Release()
+			sub.drop()
+			session.throttled++
+			continue
 		}
 
 		// send image to client
-		_, err = part.Write(data)
+		lastSendTime = time.Now()
+		err := pw.WriteFrame(frame)
+		frame.Release()
 		if err != nil {
-			fmt.Printf("server[%s]: part write failed: %s\n", pubSub.id, err)
+			session.reason = reasonWriteFailed
+			logServer.Debug("part write failed",
+				"source", pubSub.id, "client", sub.RemoteAddr, "error", err)
 			return
 		}
+		pubSub.output.Mark(size)
+		session.frames++
 
 		flusher.Flush()
+		writeTime := time.Since(lastSendTime)
+		pubSub.writeTime.Add(writeTime)
+
+		// follow the rate the client is able to receive
+		if adaptiveRate {
+			interval := control.Update(writeTime)
+			sub.setInterval(interval, control.Latency())
+		}
 	}
 
+	if !headersSent && session.reason == reasonClientClosed {
+		session.status = statusClientClosed
+		return
+	}
+	if !headersSent && session.reason == reasonEvicted {
+		session.status = http.StatusServiceUnavailable
+		http.Error(w, "Viewer evicted", http.StatusServiceUnavailable)
+		return
+	}
 	if !headersSent && !chunkOk {
-		fmt.Printf("server[%s]: stream failed\n", pubSub.id)
+		session.status = http.StatusServiceUnavailable
+		session.reason = reasonSourceFailed
+		logServer.Warn("stream failed", "source", pubSub.id, "client", sub.RemoteAddr)
 		http.Error(w, "Stream failed", http.StatusServiceUnavailable)
 		return
 	}
 
-	err = mw.Close()
+	err = pw.Close()
 	if err != nil {
-		fmt.Printf("server[%s]: mime close failed: %s\n", pubSub.id, err)
+		logServer.Debug("mime close failed",
+			"source", pubSub.id, "client", sub.RemoteAddr, "error", err)
 	}
 }
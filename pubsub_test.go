@@ -0,0 +1,45 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDroppedTotal(t *testing.T) {
+	source := &testSource{start: make(chan struct{})}
+	pubSub := newTestSource(t, "/dropped", source)
+
+	sub := NewSubscriber("viewer")
+	pubSub.Subscribe(sub)
+	sub.drop()
+	sub.drop()
+	if dropped := pubSub.Status().Dropped; dropped != 2 {
+		t.Fatalf("dropped %d while subscribed", dropped)
+	}
+
+	pubSub.Unsubscribe(sub)
+	if dropped := pubSub.Status().Dropped; dropped != 2 {
+		t.Fatalf("dropped %d after unsubscribing", dropped)
+	}
+	if dropped := pubSub.baseStatus().Dropped; dropped != 2 {
+		t.Fatalf("dropped %d without the loop", dropped)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	globalBandwidth *tokenBucket
+	sourceBandwidth int
+	clientBandwidth int
+)
+
+// tokenBucket limits output in bytes per second. Whole frames are
+// either sent or dropped, so a frame larger than the bucket is allowed
+// once the bucket is full and the debt is paid off afterwards.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for the given kbit/s rate, or nil
+// if the rate is not limited.
+func newTokenBucket(kbps int) *tokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+
+	bucket := new(tokenBucket)
+
+	bucket.rate = float64(kbps) * 1000 / 8
+	bucket.burst = bucket.rate
+	bucket.tokens = bucket.burst
+	bucket.last = time.Now()
+
+	return bucket
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+func (bucket *tokenBucket) allows(size float64) bool {
+	return bucket.tokens >= size || bucket.tokens >= bucket.burst
+}
+
+// takeFrame consumes size bytes from all buckets, or from none of them
+// if any bucket is out of budget. Buckets are always locked in the same
+// order, nil buckets are not limited.
+func takeFrame(size int, buckets ...*tokenBucket) bool {
+	now := time.Now()
+
+	locked := make([]*tokenBucket, 0, len(buckets))
+	defer func() {
+		for _, bucket := range locked {
+			bucket.mu.Unlock()
+		}
+	}()
+
+	for _, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+		bucket.mu.Lock()
+		locked = append(locked, bucket)
+
+		bucket.refill(now)
+		if !bucket.allows(float64(size)) {
+			return false
+		}
+	}
+
+	for _, bucket := range locked {
+		bucket.tokens -= float64(size)
+	}
+
+	return true
+}
@@ -0,0 +1,261 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleReject      = "reject"
+	schedulePlaceholder = "placeholder"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleRange is a time window on some days of the week. A window
+// that wraps around midnight belongs to the day it starts on.
+type scheduleRange struct {
+	days   [7]bool
+	window timeWindow
+}
+
+// schedule limits when a source may be viewed and connected.
+type schedule struct {
+	location *time.Location
+	ranges   []scheduleRange
+}
+
+// parseDays parses "Mon-Fri", "Sat,Sun" or "*".
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+
+	if spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, ok := weekdays[first]
+		if !ok {
+			return days, fmt.Errorf("invalid weekday: %s", first)
+		}
+		end := start
+		if isRange {
+			end, ok = weekdays[last]
+			if !ok {
+				return days, fmt.Errorf("invalid weekday: %s", last)
+			}
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseScheduleRange parses "Mon-Fri 08:00-18:00", a bare time window
+// that applies to every day or bare days like "Sat,Sun" open all day.
+func parseScheduleRange(spec string) (scheduleRange, error) {
+	var r scheduleRange
+
+	fields := strings.Fields(spec)
+	switch {
+	case len(fields) == 1 && strings.Contains(fields[0], ":"):
+		fields = []string{"*", fields[0]}
+	case len(fields) == 1:
+		fields = []string{fields[0], "00:00-24:00"}
+	case len(fields) == 2:
+	default:
+		return r, fmt.Errorf("invalid schedule: %s", spec)
+	}
+
+	var err error
+	r.days, err = parseDays(fields[0])
+	if err != nil {
+		return r, err
+	}
+	r.window, err = parseTimeWindow(fields[1])
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// newSchedule returns nil if there are no ranges, meaning always open.
+func newSchedule(specs []string, timeZone string) (*schedule, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	sched := new(schedule)
+
+	sched.location = time.Local
+	if timeZone != "" {
+		var err error
+		sched.location, err = time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %s", timeZone)
+		}
+	}
+
+	for _, spec := range specs {
+		r, err := parseScheduleRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		sched.ranges = append(sched.ranges, r)
+	}
+
+	return sched, nil
+}
+
+func (sched *schedule) Open(t time.Time) bool {
+	if sched == nil {
+		return true
+	}
+
+	t = t.In(sched.location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range sched.ranges {
+		day := t.Weekday()
+		if r.window.start > r.window.end && minute < r.window.end {
+			day = (day + 6) % 7 // after midnight, started the day before
+		}
+		if r.days[day] && r.window.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextOpen returns the next time the schedule opens, searching a week
+// ahead in steps of a minute.
+func (sched *schedule) NextOpen(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for i := 0; i <= 7*24*60; i++ {
+		t = t.Add(time.Minute)
+		if sched.Open(t) {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// loadPlaceholder reads the placeholder image or draws a plain one.
+func loadPlaceholder(filename string) ([]byte, error) {
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, ok := jpegSize(data); !ok {
+			return nil, fmt.Errorf("not a JPEG image: %s", filename)
+		}
+		return data, nil
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 640, 480))
+	for i := range img.Pix {
+		img.Pix[i] = 0x40
+	}
+	// a lighter bar across the middle marks the image as a placeholder
+	bar := image.Rect(0, 232, 640, 248)
+	for y := bar.Min.Y; y < bar.Max.Y; y++ {
+		for x := bar.Min.X; x < bar.Max.X; x++ {
+			img.SetGray(x, y, color.Gray{Y: 0x80})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// serveClosed answers viewers outside the schedule, either with an
+// error or with a single placeholder frame.
+func (pubSub *PubSub) serveClosed(w http.ResponseWriter, r *http.Request, session *accessSession) {
+	message := "Source not available at this time"
+	if next, ok := pubSub.schedule.NextOpen(time.Now()); ok {
+		message = fmt.Sprintf("%s, next available at %s", message,
+			next.In(pubSub.schedule.location).Format(time.RFC1123))
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(next).Seconds())))
+	}
+	w.Header().Set("X-Source-State", "closed")
+
+	if pubSub.closedAction != schedulePlaceholder || r.Method == http.MethodHead {
+		session.status = http.StatusServiceUnavailable
+		session.reason = reasonClosed
+		http.Error(w, message, http.StatusServiceUnavailable)
+		return
+	}
+
+	boundary := randomBoundary()
+	w.Header().Set("Content-Type",
+		fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", boundary))
+	w.Header().Set("X-Message", message)
+	w.WriteHeader(http.StatusOK)
+	session.status = http.StatusOK
+	session.reason = reasonClosed
+
+	cw := &countingWriter{w: w}
+	pw := newPartWriter(cw, boundary)
+	frame := &Frame{Data: pubSub.placeholder, Time: time.Now()} // not pooled
+	err := pw.WriteFrame(frame)
+	if err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		session.reason = reasonWriteFailed
+	}
+	session.frames = 1
+	session.bytes = cw.n
+}
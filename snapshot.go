@@ -0,0 +1,149 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	snapshotMaxAge  = 2 * time.Second
+	snapshotTimeout = 10 * time.Second
+)
+
+var errSnapshotTimeout = errors.New("no frame received in time")
+
+// cachedFrame returns a reference to the most recent frame while the
+// source is connected, or nil. It runs in the loop.
+func (pubSub *PubSub) cachedFrame() *Frame {
+	if pubSub.pubChan == nil || pubSub.lastFrame == nil {
+		return nil
+	}
+	if time.Since(pubSub.lastFrame.Time) > snapshotMaxAge {
+		return nil
+	}
+
+	pubSub.lastFrame.Retain()
+	return pubSub.lastFrame
+}
+
+// CachedFrame returns a reference to a current frame of a connected
+// source, or nil without connecting it. The caller releases the frame.
+func (pubSub *PubSub) CachedFrame() *Frame {
+	reply := make(chan *Frame, 1)
+	pubSub.snapChan <- reply
+
+	return <-reply
+}
+
+// Snapshot returns a reference to a current frame, waiting for the next
+// one if the source is not connected yet. The caller releases the frame.
+func (pubSub *PubSub) Snapshot(client string) (*Frame, error) {
+	if frame := pubSub.CachedFrame(); frame != nil {
+		return frame, nil
+	}
+
+	sub := NewSubscriber(client)
+	sub.Source = pubSub.id
+	sub.setDelivery(deliveryLatest, 1)
+	pubSub.Subscribe(sub)
+	defer func() {
+		pubSub.Unsubscribe(sub)
+		sub.releaseQueued()
+	}()
+
+	timer := time.NewTimer(snapshotTimeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok {
+			return nil, errors.New("stream failed")
+		}
+		return frame, nil
+	case <-timer.C:
+		return nil, errSnapshotTimeout
+	}
+}
+
+func writeJPEG(w http.ResponseWriter, r *http.Request, data []byte, session *accessSession) {
+	header := w.Header()
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	session.status = http.StatusOK
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	n, err := w.Write(data)
+	session.bytes = int64(n)
+	if err != nil {
+		session.reason = reasonWriteFailed
+		return
+	}
+	session.frames = 1
+}
+
+// serveSnapshot answers ?action=snapshot with a single JPEG image. With
+// cached=1 an idle source is not connected and gets 204 No Content.
+func (pubSub *PubSub) serveSnapshot(w http.ResponseWriter, r *http.Request, session *accessSession) {
+	if !pubSub.schedule.Open(time.Now()) {
+		if pubSub.closedAction == schedulePlaceholder {
+			session.reason = reasonClosed
+			writeJPEG(w, r, pubSub.placeholder, session)
+			return
+		}
+		pubSub.serveClosed(w, r, session)
+		return
+	}
+
+	if r.URL.Query().Get("cached") == "1" {
+		frame := pubSub.CachedFrame()
+		if frame == nil {
+			session.status = http.StatusNoContent
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		defer frame.Release()
+
+		w.Header().Set("X-Frame-Seq", strconv.FormatUint(frame.Seq, 10))
+		writeJPEG(w, r, frame.Data, session)
+		return
+	}
+
+	frame, err := pubSub.Snapshot(clientAddress(r))
+	if err != nil {
+		session.status = http.StatusServiceUnavailable
+		session.reason = reasonSourceFailed
+		logServer.Debug("snapshot failed", "source", pubSub.id, "client", r.RemoteAddr, "error", err)
+		http.Error(w, "Snapshot failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer frame.Release()
+
+	w.Header().Set("X-Frame-Seq", strconv.FormatUint(frame.Seq, 10))
+	writeJPEG(w, r, frame.Data, session)
+}
@@ -0,0 +1,331 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateWindow    = 5 * time.Second
+	statusTimeout = 2 * time.Second
+)
+
+type rateMeter struct {
+	mu     sync.Mutex
+	start  time.Time
+	frames int
+	bytes  int
+	fps    float64
+	bps    float64
+}
+
+func newRateMeter() *rateMeter {
+	meter := new(rateMeter)
+
+	meter.start = time.Now()
+
+	return meter
+}
+
+// roll closes the current window once it is long enough.
+func (meter *rateMeter) roll(now time.Time) {
+	elapsed := now.Sub(meter.start)
+	if elapsed < rateWindow {
+		return
+	}
+
+	meter.fps = float64(meter.frames) / elapsed.Seconds()
+	meter.bps = float64(meter.bytes*8) / elapsed.Seconds()
+	meter.frames = 0
+	meter.bytes = 0
+	meter.start = now
+}
+
+func (meter *rateMeter) Mark(size int) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	meter.roll(time.Now())
+	meter.frames++
+	meter.bytes += size
+}
+
+// Rates returns frames and bits per second from the last full window.
+func (meter *rateMeter) Rates() (float64, float64) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	meter.roll(time.Now())
+	return meter.fps, meter.bps
+}
+
+type SubscriberStatus struct {
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectTime  time.Time `json:"connect_time"`
+	Fps          float64   `json:"fps"`
+	Delivery     string    `json:"delivery"`
+	Queued       int       `json:"queued"`
+	EffectiveFps float64   `json:"effective_fps"`
+	WriteLatency float64   `json:"write_latency"`
+	Dropped      uint64    `json:"dropped"`
+}
+
+type SourceStatus struct {
+	Path            string             `json:"path"`
+	Source          string             `json:"source"`
+	State           string             `json:"state"`
+	LastFrame       *time.Time         `json:"last_frame,omitempty"`
+	LastFrameAge    float64            `json:"last_frame_age,omitempty"`
+	LastError       string             `json:"last_error,omitempty"`
+	InputFps        float64            `json:"input_fps"`
+	OutputBitrate   float64            `json:"output_bitrate"`
+	Boundary        string             `json:"boundary,omitempty"`
+	ContentType     string             `json:"content_type,omitempty"`
+	InputJitter     LatencyStatus      `json:"input_jitter"`
+	QueueWait       LatencyStatus      `json:"queue_wait"`
+	WriteTime       LatencyStatus      `json:"write_time"`
+	Duplicates      uint64             `json:"duplicates,omitempty"`
+	Stuck           bool               `json:"stuck,omitempty"`
+	Rejected        uint64             `json:"rejected,omitempty"`
+	Dropped         uint64             `json:"dropped"`
+	MinFps          float64            `json:"min_fps,omitempty"`
+	MaxWriteLatency float64            `json:"max_write_latency"`
+	MaxSubscribers  int                `json:"max_subscribers"`
+	Subscribers     []SubscriberStatus `json:"subscribers"`
+}
+
+type StatusReport struct {
+	Limits  LimitStatus    `json:"limits"`
+	Sources []SourceStatus `json:"sources"`
+}
+
+// baseStatus collects the fields that are safe to read outside the loop.
+func (pubSub *PubSub) baseStatus() SourceStatus {
+	chunker := pubSub.chunker
+	state, lastFrame, lastError := chunker.Stats()
+
+	status := SourceStatus{
+		Path:      pubSub.id,
+		Source:    chunker.source.Redacted(),
+		State:     state,
+		LastError: lastError,
+	}
+	if !lastFrame.IsZero() {
+		status.LastFrame = &lastFrame
+		status.LastFrameAge = time.Since(lastFrame).Seconds()
+	}
+	status.InputFps, _ = chunker.input.Rates()
+	_, status.OutputBitrate = pubSub.output.Rates()
+	status.InputJitter = chunker.jitter.Status()
+	if chunker.dedup != nil {
+		status.Duplicates = chunker.dedup.Duplicates()
+		status.Stuck = chunker.dedup.Stuck()
+	}
+	status.Rejected = chunker.validator.Rejected()
+	status.Dropped = atomic.LoadUint64(&pubSub.dropped)
+	status.QueueWait = pubSub.queueWait.Status()
+	status.WriteTime = pubSub.writeTime.Status()
+	status.MaxSubscribers = viewerLimits.sourceLimit(pubSub)
+
+	return status
+}
+
+// intervalRate converts a frame interval to fps, zero if not limited.
+func intervalRate(interval time.Duration) float64 {
+	if interval <= 0 {
+		return 0
+	}
+
+	return 1 / interval.Seconds()
+}
+
+func (pubSub *PubSub) doStatus() SourceStatus {
+	status := pubSub.baseStatus()
+	status.Boundary = pubSub.chunker.boundary
+	status.ContentType = pubSub.chunker.GetHeader().Get("Content-Type")
+
+	status.Subscribers = make([]SubscriberStatus, 0, len(pubSub.subscribers))
+	for s := range pubSub.subscribers {
+		status.Subscribers = append(status.Subscribers, SubscriberStatus{
+			RemoteAddr:   s.RemoteAddr,
+			ConnectTime:  s.ConnectTime,
+			Fps:          s.Fps,
+			Delivery:     s.Delivery,
+			Queued:       len(s.ChunkChannel),
+			EffectiveFps: intervalRate(s.Interval()),
+			WriteLatency: s.WriteLatency().Seconds(),
+			Dropped:      s.Dropped(),
+		})
+	}
+	for _, sub := range status.Subscribers {
+		if sub.EffectiveFps > 0 && (status.MinFps == 0 || sub.EffectiveFps < status.MinFps) {
+			status.MinFps = sub.EffectiveFps
+		}
+		if sub.WriteLatency > status.MaxWriteLatency {
+			status.MaxWriteLatency = sub.WriteLatency
+		}
+	}
+	sort.Slice(status.Subscribers, func(i, j int) bool {
+		return status.Subscribers[i].ConnectTime.Before(status.Subscribers[j].ConnectTime)
+	})
+
+	return status
+}
+
+// Status asks the loop for a snapshot, falling back to partial data
+// while the loop is busy connecting to the source.
+func (pubSub *PubSub) Status() SourceStatus {
+	reply := make(chan SourceStatus, 1)
+
+	timer := time.NewTimer(statusTimeout)
+	defer timer.Stop()
+
+	select {
+	case pubSub.statusChan <- reply:
+		return <-reply
+	case <-timer.C:
+		return pubSub.baseStatus()
+	}
+}
+
+// collectStatus reports the sources the client may view.
+func collectStatus(r *http.Request) StatusReport {
+	sources := visibleSources(r)
+	statuses := make([]SourceStatus, len(sources))
+
+	var wg sync.WaitGroup
+	for i, pubSub := range sources {
+		wg.Add(1)
+		go func(i int, pubSub *PubSub) {
+			defer wg.Done()
+			statuses[i] = pubSub.Status()
+		}(i, pubSub)
+	}
+	wg.Wait()
+
+	return StatusReport{
+		Limits:  viewerLimits.Status(),
+		Sources: statuses,
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String()
+	},
+	"age": func(seconds float64) string {
+		return time.Duration(seconds * float64(time.Second)).Truncate(time.Millisecond).String()
+	},
+	"latency": func(l LatencyStatus) string {
+		if l.Samples == 0 {
+			return "no samples"
+		}
+		return fmt.Sprintf("%.1f / %.1f / %.1f / %.1f ms",
+			l.P50*1000, l.P90*1000, l.P99*1000, l.Max*1000)
+	},
+	"kbps": func(bps float64) string {
+		return fmt.Sprintf("%.1f", bps/1000)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mjpeg-proxy status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>mjpeg-proxy status</h1>
+{{with .Limits}}
+<table>
+<tr><th>Viewers</th><td>{{.Clients}}{{if .MaxClients}} / {{.MaxClients}}{{end}}</td></tr>
+<tr><th>Max viewers per client</th><td>{{if .MaxClientsPerIP}}{{.MaxClientsPerIP}}{{else}}unlimited{{end}}</td></tr>
+<tr><th>Eviction</th><td>{{if .Evict}}oldest anonymous viewer{{else}}disabled{{end}}</td></tr>
+<tr><th>Rejected / evicted</th><td>{{.Rejected}} / {{.Evicted}}</td></tr>
+</table>
+{{end}}
+{{range .Sources}}
+<h2>{{.Path}}</h2>
+<table>
+<tr><th>Source</th><td>{{.Source}}</td></tr>
+<tr><th>State</th><td>{{.State}}</td></tr>
+<tr><th>Last frame</th><td>{{if .LastFrame}}{{age .LastFrameAge}} ago{{else}}never{{end}}</td></tr>
+{{if .LastError}}<tr><th>Last error</th><td>{{.LastError}}</td></tr>{{end}}
+{{if .Stuck}}<tr><th>Camera</th><td>stuck, repeating the same image</td></tr>{{end}}
+{{if .Duplicates}}<tr><th>Duplicate frames dropped</th><td>{{.Duplicates}}</td></tr>{{end}}
+{{if .Rejected}}<tr><th>Invalid frames rejected</th><td>{{.Rejected}}</td></tr>{{end}}
+<tr><th>Input fps</th><td>{{printf "%.1f" .InputFps}}</td></tr>
+<tr><th>Output kbit/s</th><td>{{kbps .OutputBitrate}}</td></tr>
+<tr><th>Input jitter (p50 / p90 / p99 / max)</th><td>{{latency .InputJitter}}</td></tr>
+<tr><th>Queue wait (p50 / p90 / p99 / max)</th><td>{{latency .QueueWait}}</td></tr>
+<tr><th>Write time (p50 / p90 / p99 / max)</th><td>{{latency .WriteTime}}</td></tr>
+<tr><th>Boundary</th><td>{{.Boundary}}</td></tr>
+<tr><th>Content-Type</th><td>{{.ContentType}}</td></tr>
+<tr><th>Max viewers</th><td>{{if .MaxSubscribers}}{{.MaxSubscribers}}{{else}}unlimited{{end}}</td></tr>
+</table>
+<table>
+<tr><th>Client</th><th>Connected</th><th>Requested fps</th><th>Delivery</th><th>Effective fps</th><th>Write latency</th><th>Dropped frames</th></tr>
+{{range .Subscribers}}
+<tr><td>{{.RemoteAddr}}</td><td>{{since .ConnectTime}}</td><td>{{if .Fps}}{{.Fps}}{{else}}max{{end}}</td><td>{{.Delivery}}{{if .Queued}} ({{.Queued}} queued){{end}}</td><td>{{if .EffectiveFps}}{{printf "%.1f" .EffectiveFps}}{{else}}max{{end}}</td><td>{{age .WriteLatency}}</td><td>{{.Dropped}}</td></tr>
+{{else}}
+<tr><td colspan="7">no subscribers</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	report := collectStatus(r)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(report)
+	if err != nil {
+		logServer.Error("status encode failed", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+func statusHTMLHandler(w http.ResponseWriter, r *http.Request) {
+	report := collectStatus(r)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := statusTemplate.Execute(w, report)
+	if err != nil {
+		logServer.Error("status template failed", "client", r.RemoteAddr, "error", err)
+	}
+}
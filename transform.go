@@ -0,0 +1,390 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+const exifOrientation = 0x0112
+
+type configTransform struct {
+	Rotate   int    // clockwise degrees: 0, 90, 180 or 270
+	FlipH    bool   // mirror left to right
+	FlipV    bool   // mirror top to bottom
+	Crop     string // "x,y,width,height" in source pixels
+	ExifOnly bool   // only tag flips and half turns, for clients that honour EXIF
+	Quality  int
+}
+
+// Transform crops, flips and rotates frames, in that order, and encodes
+// the result. With ExifOnly, flips and 180 degree rotation without a crop
+// only set the EXIF orientation so the image data stays untouched, but
+// viewers and decoders that ignore EXIF then show the original image.
+type Transform struct {
+	rotate   int
+	flipH    bool
+	flipV    bool
+	crop     image.Rectangle
+	exifOnly bool
+	quality  int
+}
+
+// newTransform returns nil if the configuration changes nothing.
+func newTransform(conf configTransform) (*Transform, error) {
+	transform := new(Transform)
+
+	switch conf.Rotate {
+	case 0, 90, 180, 270:
+		transform.rotate = conf.Rotate
+	default:
+		return nil, fmt.Errorf("invalid rotation: %d", conf.Rotate)
+	}
+	transform.flipH = conf.FlipH
+	transform.flipV = conf.FlipV
+
+	if conf.Crop != "" {
+		var x, y, w, h int
+		n, _ := fmt.Sscanf(conf.Crop, "%d,%d,%d,%d", &x, &y, &w, &h)
+		if n != 4 || x < 0 || y < 0 || w <= 0 || h <= 0 {
+			return nil, fmt.Errorf("invalid crop: %s", conf.Crop)
+		}
+		transform.crop = image.Rect(x, y, x+w, y+h)
+	}
+
+	transform.exifOnly = conf.ExifOnly
+	transform.quality = conf.Quality
+	if transform.quality < 0 || transform.quality > 100 {
+		return nil, fmt.Errorf("invalid quality: %d", conf.Quality)
+	}
+	if transform.quality == 0 {
+		transform.quality = 90
+	}
+
+	if transform.rotate == 0 && !transform.flipH && !transform.flipV && transform.crop.Empty() {
+		return nil, nil
+	}
+
+	return transform, nil
+}
+
+// orientation returns the EXIF orientation for the flips and rotation,
+// or zero if they can not be expressed without a transposition.
+func (transform *Transform) orientation() int {
+	if transform.rotate == 90 || transform.rotate == 270 {
+		return 0
+	}
+
+	// a vertical flip is a horizontal flip rotated by 180 degrees
+	half := transform.rotate == 180
+	mirror := transform.flipH
+	if transform.flipV {
+		half = !half
+		mirror = !mirror
+	}
+
+	switch {
+	case !half && !mirror:
+		return 1
+	case !half && mirror:
+		return 2
+	case half && !mirror:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Apply returns a new frame with the transformed image, the input frame
+// is left for the caller to release.
+func (transform *Transform) Apply(frame *Frame) (*Frame, error) {
+	var out *Frame
+	var err error
+
+	orientation := combineOrientation(jpegOrientation(frame.Data), transform.orientation())
+	if orientation > 0 && transform.exifOnly && transform.crop.Empty() {
+		out, err = setOrientation(frame.Data, orientation)
+	} else {
+		out, err = transform.reencodeFrame(frame.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out.Time = frame.Time
+	out.Header = frame.Header
+	out.Width, out.Height, _ = jpegSize(out.Data)
+
+	return out, nil
+}
+
+// combineOrientation applies orientation b on top of a, zero if the
+// result needs a transposition. Orientations 1 to 4 are a mirror and a
+// half turn, so they combine by toggling each.
+func combineOrientation(a, b int) int {
+	if a < 1 || a > 4 || b < 1 || b > 4 {
+		return 0
+	}
+
+	return ((a - 1) ^ (b - 1)) + 1
+}
+
+// jpegOrientation reads the EXIF orientation, 1 if the image has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 { // image data or end
+			break
+		}
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if end > len(data) {
+			break
+		}
+		segment := data[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i = end
+	}
+
+	return 1
+}
+
+// tiffOrientation finds the orientation tag in the first IFD.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientation {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// decodeJPEG decodes a frame upright. The JPEG decoder ignores EXIF, so
+// the orientation set by lossless transforms or the camera is applied to
+// the pixels here.
+func decodeJPEG(data []byte) (image.Image, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		return src, nil
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 { // transposed
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	ycc, _ := src.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = b.Dx() - 1 - x
+			case 3:
+				sx, sy = b.Dx()-1-x, b.Dy()-1-y
+			case 4:
+				sy = b.Dy() - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, b.Dy()-1-x
+			case 7:
+				sx, sy = b.Dx()-1-y, b.Dy()-1-x
+			case 8:
+				sx, sy = b.Dx()-1-y, x
+			}
+			dst.SetRGBA(x, y, rgbaAt(src, ycc, b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst, nil
+}
+
+// exifSegment builds an APP1 segment holding only the orientation tag.
+func exifSegment(orientation int) []byte {
+	return []byte{
+		0xff, 0xe1, 0x00, 0x22, // APP1, length 34
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08, // big endian TIFF, IFD at 8
+		0x00, 0x01, // one entry
+		byte(exifOrientation >> 8), byte(exifOrientation & 0xff),
+		0x00, 0x03, // SHORT
+		0x00, 0x00, 0x00, 0x01, // count
+		0x00, byte(orientation), 0x00, 0x00, // value
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+}
+
+// setOrientation copies the JPEG with existing EXIF segments replaced
+// by one carrying the orientation, after the JFIF header if present.
+func setOrientation(data []byte, orientation int) (*Frame, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG image")
+	}
+
+	segment := exifSegment(orientation)
+	out := newFrame(len(data) + len(segment))
+	out.Data = append(out.Data, data[:2]...)
+
+	i := 2
+	inserted := false
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker < 0xe0 || marker > 0xef { // past the application segments
+			break
+		}
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if end > len(data) {
+			out.Release()
+			return nil, fmt.Errorf("truncated JPEG segment")
+		}
+
+		isExif := marker == 0xe1 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00"))
+		if marker != 0xe0 && !inserted {
+			out.Data = append(out.Data, segment...)
+			inserted = true
+		}
+		if !isExif {
+			out.Data = append(out.Data, data[i:end]...)
+		}
+		i = end
+	}
+	if !inserted {
+		out.Data = append(out.Data, segment...)
+	}
+	out.Data = append(out.Data, data[i:]...)
+
+	return out, nil
+}
+
+// reencodeFrame decodes the image, transforms the pixels and encodes
+// the result.
+func (transform *Transform) reencodeFrame(data []byte) (*Frame, error) {
+	src, err := decodeJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	area := src.Bounds()
+	if !transform.crop.Empty() {
+		area = transform.crop.Add(area.Min).Intersect(area)
+		if area.Empty() {
+			return nil, fmt.Errorf("crop outside of %dx%d image", src.Bounds().Dx(), src.Bounds().Dy())
+		}
+	}
+
+	w, h := area.Dx(), area.Dy()
+	if transform.rotate == 90 || transform.rotate == 270 {
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	ycc, _ := src.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// undo the rotation, then the flips
+			sx, sy := x, y
+			switch transform.rotate {
+			case 90:
+				sx, sy = y, w-1-x
+			case 180:
+				sx, sy = w-1-x, h-1-y
+			case 270:
+				sx, sy = h-1-y, x
+			}
+			if transform.flipH {
+				sx = area.Dx() - 1 - sx
+			}
+			if transform.flipV {
+				sy = area.Dy() - 1 - sy
+			}
+			dst.SetRGBA(x, y, rgbaAt(src, ycc, area.Min.X+sx, area.Min.Y+sy))
+		}
+	}
+
+	out := newFrame(len(data))
+	buf := bytes.NewBuffer(out.Data)
+	err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: transform.quality})
+	out.Data = buf.Bytes()
+	if err != nil {
+		out.Release()
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// rgbaAt reads a pixel, directly from the planes for YCbCr images.
+func rgbaAt(src image.Image, ycc *image.YCbCr, x, y int) color.RGBA {
+	if ycc != nil {
+		yi := ycc.YOffset(x, y)
+		ci := ycc.COffset(x, y)
+		r, g, b := color.YCbCrToRGB(ycc.Y[yi], ycc.Cb[ci], ycc.Cr[ci])
+		return color.RGBA{r, g, b, 0xff}
+	}
+
+	return color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+}
@@ -0,0 +1,137 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testFrame returns a 64x32 JPEG frame, white in the top left quarter
+// and black elsewhere.
+func testFrame(t testing.TB) *Frame {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{0, 0, 0, 0xff}
+			if x < 32 && y < 16 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := newFrame(buf.Len())
+	frame.Data = append(frame.Data, buf.Bytes()...)
+	return frame
+}
+
+// whiteAt reports whether the pixel is bright, decoding without EXIF.
+func whiteAt(t *testing.T, data []byte, x, y int) bool {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, _, _ := img.At(x, y).RGBA()
+	return r > 0x8000
+}
+
+func TestTransformPixels(t *testing.T) {
+	tests := []struct {
+		conf   configTransform
+		width  int
+		height int
+		white  image.Point // a pixel that must be white
+		black  image.Point // the original white corner
+	}{
+		{configTransform{Rotate: 180}, 64, 32, image.Pt(60, 28), image.Pt(3, 3)},
+		{configTransform{Rotate: 90}, 32, 64, image.Pt(28, 3), image.Pt(3, 3)},
+		{configTransform{Rotate: 270}, 32, 64, image.Pt(3, 60), image.Pt(3, 3)},
+		{configTransform{FlipH: true}, 64, 32, image.Pt(60, 3), image.Pt(3, 3)},
+		{configTransform{FlipV: true}, 64, 32, image.Pt(3, 28), image.Pt(3, 3)},
+		{configTransform{Crop: "16,0,32,16"}, 32, 16, image.Pt(3, 3), image.Pt(28, 3)},
+	}
+
+	for _, test := range tests {
+		transform, err := newTransform(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := testFrame(t)
+		out, err := transform.Apply(in)
+		in.Release()
+		if err != nil {
+			t.Fatalf("%+v: %s", test.conf, err)
+		}
+
+		if out.Width != test.width || out.Height != test.height {
+			t.Errorf("%+v: size %dx%d", test.conf, out.Width, out.Height)
+		}
+		if jpegOrientation(out.Data) != 1 {
+			t.Errorf("%+v: EXIF orientation set", test.conf)
+		}
+		if !whiteAt(t, out.Data, test.white.X, test.white.Y) {
+			t.Errorf("%+v: %v not white", test.conf, test.white)
+		}
+		if whiteAt(t, out.Data, test.black.X, test.black.Y) {
+			t.Errorf("%+v: %v not black", test.conf, test.black)
+		}
+		out.Release()
+	}
+}
+
+func TestTransformExifOnly(t *testing.T) {
+	transform, err := newTransform(configTransform{Rotate: 180, ExifOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := testFrame(t)
+	out, err := transform.Apply(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Release()
+
+	if !bytes.HasSuffix(out.Data, in.Data[2:]) {
+		t.Error("image data changed")
+	}
+	in.Release()
+	if orientation := jpegOrientation(out.Data); orientation != 3 {
+		t.Errorf("orientation %d", orientation)
+	}
+
+	img, err := decodeJPEG(out.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, _, _ := img.At(60, 28).RGBA()
+	if r < 0x8000 {
+		t.Error("decodeJPEG ignored the orientation")
+	}
+}
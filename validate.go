@@ -0,0 +1,166 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"mime"
+	"net/textproto"
+	"sync/atomic"
+)
+
+/* Validation levels, each including the checks of the previous one:
+
+   off:     only empty parts are rejected
+   markers: part Content-Type and SOI/EOI markers
+   header:  JPEG header decodes, with the expected size if configured
+   decode:  the whole image decodes
+*/
+
+const (
+	validateOff     = "off"
+	validateMarkers = "markers"
+	validateHeader  = "header"
+	validateDecode  = "decode"
+
+	defaultMaxRejects = 25
+)
+
+type configValidate struct {
+	Level      string // markers, header or decode
+	Width      int    // expected frame size, checked from header level
+	Height     int
+	MaxRejects int // invalid frames in a row that fail the source, default 25
+}
+
+// frameValidator drops invalid frames before they are published. It runs
+// in the chunker.
+type frameValidator struct {
+	rejected uint64
+
+	level      string
+	width      int
+	height     int
+	maxRejects int
+}
+
+// newFrameValidator returns nil if frames are not validated.
+func newFrameValidator(conf configValidate) (*frameValidator, error) {
+	validator := new(frameValidator)
+
+	switch conf.Level {
+	case "", validateOff:
+		return nil, nil
+	case validateMarkers, validateHeader, validateDecode:
+		validator.level = conf.Level
+	default:
+		return nil, fmt.Errorf("unknown validation level: %s", conf.Level)
+	}
+
+	validator.width = conf.Width
+	validator.height = conf.Height
+	validator.maxRejects = conf.MaxRejects
+	if validator.maxRejects <= 0 {
+		validator.maxRejects = defaultMaxRejects
+	}
+
+	return validator, nil
+}
+
+func checkContentType(header textproto.MIMEHeader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type: %s", contentType)
+	}
+	switch mediaType {
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return nil
+	default:
+		return fmt.Errorf("unexpected content type: %s", contentType)
+	}
+}
+
+func checkMarkers(data []byte) error {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return errors.New("missing start of image")
+	}
+
+	// some cameras pad parts after the image
+	data = bytes.TrimRight(data, "\r\n\t \x00")
+	if len(data) < 2 || data[len(data)-2] != 0xff || data[len(data)-1] != 0xd9 {
+		return errors.New("missing end of image")
+	}
+
+	return nil
+}
+
+// Check returns why the frame is invalid, or nil.
+func (validator *frameValidator) Check(frame *Frame) error {
+	err := checkContentType(frame.Header)
+	if err != nil {
+		return err
+	}
+	err = checkMarkers(frame.Data)
+	if err != nil {
+		return err
+	}
+	if validator.level == validateMarkers {
+		return nil
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(frame.Data))
+	if err != nil {
+		return fmt.Errorf("invalid header: %s", err)
+	}
+	if (validator.width > 0 && config.Width != validator.width) ||
+		(validator.height > 0 && config.Height != validator.height) {
+		return fmt.Errorf("unexpected size %dx%d", config.Width, config.Height)
+	}
+	if validator.level == validateHeader {
+		return nil
+	}
+
+	_, err = jpeg.Decode(bytes.NewReader(frame.Data))
+	if err != nil {
+		return fmt.Errorf("invalid image: %s", err)
+	}
+
+	return nil
+}
+
+func (validator *frameValidator) reject() {
+	atomic.AddUint64(&validator.rejected, 1)
+}
+
+func (validator *frameValidator) Rejected() uint64 {
+	if validator == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&validator.rejected)
+}
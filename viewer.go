@@ -0,0 +1,72 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+var (
+	webTemplates = template.Must(template.ParseFS(webFiles, "web/*.html"))
+	viewerRates  = []int{1, 2, 5, 10, 15, 25}
+)
+
+func assetsHandler() http.Handler {
+	assets, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.StripPrefix("/assets/", http.FileServer(http.FS(assets)))
+}
+
+func renderPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := webTemplates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		logServer.Error("page template failed", "page", name, "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// indexHandler lists the sources with links to their viewer pages.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+
+	renderPage(w, r, "index.html", collectStatus(r))
+}
+
+// serveViewer answers ?action=view with the viewer page of the source.
+func (pubSub *PubSub) serveViewer(w http.ResponseWriter, r *http.Request, session *accessSession) {
+	session.status = http.StatusOK
+	renderPage(w, r, "viewer.html", struct {
+		Path  string
+		Rates []int
+	}{pubSub.id, viewerRates})
+}
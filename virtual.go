@@ -0,0 +1,122 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// virtualSource produces frames in place of an upstream connection.
+// It runs until the chunker is stopped.
+type virtualSource interface {
+	run(chunker *Chunker, pubChan chan *Frame)
+	sources() []string // paths of the sources it reads from
+}
+
+// findSource returns the source serving the path.
+func findSource(path string) *PubSub {
+	for _, pubSub := range proxySources {
+		if pubSub.id == path {
+			return pubSub
+		}
+	}
+
+	return nil
+}
+
+// followSource subscribes to a source on behalf of a virtual source and
+// passes on every frame until stopped. The subscription is retried
+// while the source is failing or outside its schedule.
+func followSource(pubSub *PubSub, client string, stop chan struct{}, handle func(*Frame)) {
+	if pubSub == nil {
+		return
+	}
+
+	for {
+		if pubSub.schedule.Open(time.Now()) {
+			sub := NewSubscriber(client)
+			sub.Source = pubSub.id
+			sub.setDelivery(deliveryLatest, 1)
+			pubSub.Subscribe(sub)
+
+		ReadLoop:
+			for {
+				select {
+				case frame, ok := <-sub.ChunkChannel:
+					if !ok {
+						break ReadLoop
+					}
+					handle(frame)
+				case <-stop:
+					pubSub.Unsubscribe(sub)
+					sub.releaseQueued()
+					return
+				}
+			}
+		}
+
+		select {
+		case <-time.After(keepAliveRetry):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Derived serves a transformed copy of another source, like a rotated
+// or cropped profile of a camera.
+type Derived struct {
+	parent    string
+	transform *Transform
+}
+
+func (derived *Derived) sources() []string {
+	return []string{derived.parent}
+}
+
+func (derived *Derived) run(chunker *Chunker, pubChan chan *Frame) {
+	stop := chunker.stop
+
+	followSource(findSource(derived.parent), "profile:"+chunker.id, stop, func(frame *Frame) {
+		var out *Frame
+		if derived.transform != nil {
+			var err error
+			out, err = derived.transform.Apply(frame)
+			frame.Release()
+			if err != nil {
+				logChunker.Debug("transform failed", "source", chunker.id, "error", err)
+				return
+			}
+		} else {
+			// parent frame is shared with its own subscribers
+			out = shareFrame(frame)
+		}
+
+		chunker.frameReceived(len(out.Data))
+		chunker.seq++
+		out.Seq = chunker.seq
+
+		select {
+		case pubChan <- out:
+		case <-stop:
+			out.Release()
+		}
+	})
+}
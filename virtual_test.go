@@ -0,0 +1,142 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testSource publishes copies of a frame once started.
+type testSource struct {
+	data  []byte
+	count int
+	start chan struct{}
+}
+
+func (source *testSource) sources() []string {
+	return nil
+}
+
+func (source *testSource) run(chunker *Chunker, pubChan chan *Frame) {
+	select {
+	case <-source.start:
+	case <-chunker.stop:
+		return
+	}
+
+	for i := 0; i < source.count; i++ {
+		frame := newFrame(len(source.data))
+		frame.Data = append(frame.Data, source.data...)
+		chunker.frameReceived(len(frame.Data))
+		chunker.seq++
+		frame.Seq = chunker.seq
+
+		select {
+		case pubChan <- frame:
+		case <-chunker.stop:
+			frame.Release()
+			return
+		}
+	}
+
+	<-chunker.stop
+}
+
+func newTestSource(t *testing.T, id string, virtual virtualSource) *PubSub {
+	chunker, err := NewChunker(id, "http://localhost"+id, "", "", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunker.virtual = virtual
+
+	pubSub := NewPubSub(id, chunker)
+	pubSub.Start()
+	return pubSub
+}
+
+// readSeqs reads count frames and checks they are numbered in order.
+func readSeqs(t *testing.T, name string, sub *Subscriber, data []byte, count int, done chan struct{}) {
+	defer close(done)
+
+	var last uint64
+	for i := 0; i < count; i++ {
+		select {
+		case frame := <-sub.ChunkChannel:
+			if last > 0 && frame.Seq != last+1 {
+				t.Errorf("%s: frame %d after %d", name, frame.Seq, last)
+			}
+			if !bytes.Equal(frame.Data, data) {
+				t.Errorf("%s: frame %d data changed", name, frame.Seq)
+			}
+			last = frame.Seq
+			frame.Release()
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: timeout after frame %d", name, last)
+			return
+		}
+	}
+}
+
+func TestDerivedSequence(t *testing.T) {
+	frame := testFrame(t)
+	defer frame.Release()
+
+	const count = 50
+	source := &testSource{data: frame.Data, count: count, start: make(chan struct{})}
+	parent := newTestSource(t, "/parent", source)
+	derived := newTestSource(t, "/parent/profile", &Derived{parent: "/parent"})
+
+	saved := proxySources
+	proxySources = []*PubSub{parent, derived}
+	defer func() { proxySources = saved }()
+
+	direct := NewSubscriber("direct")
+	direct.setDelivery(deliveryQueue, count)
+	parent.Subscribe(direct)
+	profile := NewSubscriber("profile")
+	profile.setDelivery(deliveryQueue, count)
+	derived.Subscribe(profile)
+
+	// wait for the profile to follow the parent
+	for i := 0; ; i++ {
+		if len(parent.Status().Subscribers) == 2 {
+			break
+		}
+		if i == 500 {
+			t.Fatal("profile did not subscribe to the parent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	directDone := make(chan struct{})
+	profileDone := make(chan struct{})
+	go readSeqs(t, "parent", direct, frame.Data, count, directDone)
+	go readSeqs(t, "profile", profile, frame.Data, 1, profileDone)
+	close(source.start)
+	<-directDone
+	<-profileDone
+
+	derived.Unsubscribe(profile)
+	profile.releaseQueued()
+	parent.Unsubscribe(direct)
+	direct.releaseQueued()
+}
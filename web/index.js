@@ -0,0 +1,37 @@
+// refresh the source thumbnails from cached snapshots, which do not
+// connect idle sources, and keep the last image while a source is idle
+(function () {
+  "use strict";
+
+  var interval = 5000;
+
+  function refresh() {
+    document.querySelectorAll("img.thumb").forEach(function (img) {
+      fetch(img.dataset.src + "&t=" + Date.now()).then(function (resp) {
+        if (resp.status === 204) {
+          img.classList.add("idle");
+          img.classList.remove("offline");
+          return null;
+        }
+        if (!resp.ok) {
+          throw new Error(resp.statusText);
+        }
+        return resp.blob();
+      }).then(function (blob) {
+        if (!blob) {
+          return;
+        }
+        if (img.src.startsWith("blob:")) {
+          URL.revokeObjectURL(img.src);
+        }
+        img.src = URL.createObjectURL(blob);
+        img.classList.remove("idle", "offline");
+      }).catch(function () {
+        img.classList.add("offline");
+      });
+    });
+  }
+
+  refresh();
+  setInterval(refresh, interval);
+})();
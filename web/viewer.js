@@ -0,0 +1,74 @@
+// stream viewer with reconnect on errors
+(function () {
+  "use strict";
+
+  var source = document.body.dataset.source;
+  var stream = document.getElementById("stream");
+  var status = document.getElementById("status");
+  var fps = document.getElementById("fps");
+  var retryDelay = 1000;
+  var maxRetryDelay = 30000;
+  var retryTimer = null;
+
+  function streamURL() {
+    var params = new URLSearchParams();
+    if (fps.value) {
+      params.set("fps", fps.value);
+    }
+    params.set("t", Date.now());
+    return source + "?" + params.toString();
+  }
+
+  function connect() {
+    clearTimeout(retryTimer);
+    status.textContent = "connecting";
+    stream.src = streamURL();
+  }
+
+  // a multipart stream loads once the first frame arrives
+  stream.onload = function () {
+    status.textContent = "";
+    retryDelay = 1000;
+  };
+
+  stream.onerror = function () {
+    status.textContent = "stream failed, retrying in " + retryDelay / 1000 + "s";
+    retryTimer = setTimeout(connect, retryDelay);
+    retryDelay = Math.min(retryDelay * 2, maxRetryDelay);
+  };
+
+  fps.onchange = connect;
+
+  document.getElementById("fullscreen").onclick = function () {
+    var screen = document.getElementById("screen");
+    if (document.fullscreenElement) {
+      document.exitFullscreen();
+    } else if (screen.requestFullscreen) {
+      screen.requestFullscreen();
+    }
+  };
+
+  document.getElementById("snapshot").onclick = function () {
+    fetch(source + "?action=snapshot", { cache: "no-store" })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        return response.blob();
+      })
+      .then(function (blob) {
+        var name = source.replace(/^\/+|\/+$/g, "").replace(/\//g, "-") || "snapshot";
+        var stamp = new Date().toISOString().replace(/[:.]/g, "-");
+        var link = document.createElement("a");
+        link.href = URL.createObjectURL(blob);
+        link.download = name + "-" + stamp + ".jpg";
+        link.click();
+        URL.revokeObjectURL(link.href);
+      })
+      .catch(function (err) {
+        status.textContent = "snapshot failed: " + err.message;
+      });
+  };
+
+  connect();
+})();
@@ -0,0 +1,459 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* WebSocket viewers connect to the source path with an upgrade request.
+   Each frame is sent as a text message with JSON metadata followed by
+   a binary message with the JPEG image. Clients can send commands as
+   text messages:
+
+   {"fps": 2}        change the frame rate, 0 for the source rate
+   {"pause": true}   stop sending frames until resumed
+*/
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessage   = 4096
+	wsWriteTimeout = 30 * time.Second
+
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+
+	wsCloseNormal    = 1000
+	wsCloseGoingAway = 1001
+	wsCloseProtocol  = 1002
+	wsCloseTooBig    = 1009
+	wsCloseError     = 1011
+)
+
+// wsOrigins are the browser origins allowed to open WebSocket streams
+// besides pages served from the proxy host itself.
+var wsOrigins []string
+
+// checkOrigin stops pages on other sites from reading frames with the
+// credentials or network access of the browser. Clients that are not
+// browsers send no Origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range wsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wsConn is a server side WebSocket connection. Writes are serialized
+// since the reader answers pings while frames are being sent.
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	mu      sync.Mutex
+	header  []byte
+	written int64
+}
+
+type wsCommand struct {
+	Fps   *float64 `json:"fps"`
+	Pause *bool    `json:"pause"`
+}
+
+type wsFrameInfo struct {
+	Seq       uint64  `json:"seq"`
+	Timestamp float64 `json:"timestamp"`
+	Capture   string  `json:"capture,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Size      int     `json:"size"`
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkWebSocket validates the handshake before the viewer is counted
+// or subscribed.
+func checkWebSocket(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return http.StatusBadRequest, errors.New("unsupported websocket version")
+	}
+	if !checkOrigin(r) {
+		return http.StatusForbidden, errors.New("origin not allowed")
+	}
+
+	return http.StatusOK, nil
+}
+
+// upgradeWebSocket takes over the connection of a checked handshake.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, int, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, http.StatusInternalServerError, errors.New("connection can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	ws := &wsConn{conn: conn, br: rw.Reader}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err = io.WriteString(conn, response)
+	if err != nil {
+		conn.Close()
+		return nil, http.StatusSwitchingProtocols, err
+	}
+
+	return ws, http.StatusSwitchingProtocols, nil
+}
+
+// WriteMessage sends an unfragmented, unmasked message.
+func (ws *wsConn) WriteMessage(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.header = append(ws.header[:0], 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		ws.header = append(ws.header, byte(n))
+	case n <= 0xffff:
+		ws.header = append(ws.header, 126)
+		ws.header = binary.BigEndian.AppendUint16(ws.header, uint16(n))
+	default:
+		ws.header = append(ws.header, 127)
+		ws.header = binary.BigEndian.AppendUint64(ws.header, uint64(n))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	vec := net.Buffers{ws.header, payload}
+	n, err := vec.WriteTo(ws.conn)
+	ws.written += n
+
+	return err
+}
+
+func (ws *wsConn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	return ws.WriteMessage(wsClose, payload)
+}
+
+func (ws *wsConn) Written() int64 {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.written
+}
+
+// readFrame reads one client frame and unmasks the payload.
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(ws.br, head[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("client frame not masked")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if opcode&0x8 != 0 && (!fin || length > 125) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, errMessageTooBig
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.br, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(ws.br, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+var errMessageTooBig = errors.New("message too big")
+
+// readCommands handles client messages until the connection fails or
+// the client closes it, and then closes done.
+func (ws *wsConn) readCommands(commands chan<- wsCommand, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			if err == errMessageTooBig {
+				ws.WriteClose(wsCloseTooBig, err.Error())
+			} else if err != io.EOF {
+				ws.WriteClose(wsCloseProtocol, err.Error())
+			}
+			return
+		}
+
+		switch opcode {
+		case wsPing:
+			ws.WriteMessage(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.WriteMessage(wsClose, payload)
+			return
+		case 0x0, wsText, wsBinary:
+			message = append(message, payload...)
+			if len(message) > wsMaxMessage {
+				ws.WriteClose(wsCloseTooBig, errMessageTooBig.Error())
+				return
+			}
+		default:
+			ws.WriteClose(wsCloseProtocol, "unknown opcode")
+			return
+		}
+		if !fin {
+			continue
+		}
+
+		var cmd wsCommand
+		err = json.Unmarshal(message, &cmd)
+		message = message[:0]
+		if err != nil {
+			logServer.Debug("invalid websocket command", "error", err)
+			continue
+		}
+		select {
+		case commands <- cmd:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func newFrameInfo(frame *Frame) wsFrameInfo {
+	info := wsFrameInfo{
+		Seq:     frame.Seq,
+		Capture: frame.Header.Get("X-Timestamp"),
+		Width:   frame.Width,
+		Height:  frame.Height,
+		Size:    len(frame.Data),
+	}
+	if !frame.Time.IsZero() {
+		info.Timestamp = float64(frame.Time.UnixNano()) / float64(time.Second)
+	}
+
+	return info
+}
+
+// serveWebSocket streams frames to an upgraded connection for an
+// already subscribed viewer.
+func (pubSub *PubSub) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *Subscriber,
+	session *accessSession, bandwidth *tokenBucket, control *rateController) {
+	ws, status, err := upgradeWebSocket(w, r)
+	session.status = status
+	if err != nil {
+		session.reason = reasonWriteFailed
+		if status != http.StatusSwitchingProtocols {
+			http.Error(w, err.Error(), status)
+		}
+		logServer.Debug("websocket upgrade failed",
+			"source", pubSub.id, "client", sub.RemoteAddr, "error", err)
+		return
+	}
+
+	commands := make(chan wsCommand)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go ws.readCommands(commands, quit, done)
+	defer func() {
+		close(quit)
+		ws.conn.Close() // stops the reader
+		<-done
+		session.bytes = ws.Written()
+	}()
+
+	paused := false
+	var lastSendTime time.Time
+
+LOOP:
+	for {
+		var frame *Frame
+		select {
+		case f, ok := <-sub.ChunkChannel:
+			if !ok {
+				switch {
+				case sub.lagging:
+					session.reason = reasonLagging
+					ws.WriteClose(wsCloseGoingAway, "viewer too slow")
+				case session.frames == 0:
+					session.reason = reasonSourceFailed
+					ws.WriteClose(wsCloseError, "stream failed")
+				default:
+					session.reason = reasonSourceEnded
+					ws.WriteClose(wsCloseGoingAway, "stream ended")
+				}
+				break LOOP
+			}
+			frame = f
+			pubSub.queueWait.Add(time.Since(frame.Time))
+		case cmd := <-commands:
+			if cmd.Fps != nil {
+				control = newRateController(frameInterval(*cmd.Fps))
+				sub.setInterval(frameInterval(*cmd.Fps), 0)
+			}
+			if cmd.Pause != nil {
+				paused = *cmd.Pause
+			}
+			continue
+		case <-done:
+			session.reason = reasonClientClosed
+			break LOOP
+		case <-sub.evict:
+			session.reason = reasonEvicted
+			ws.WriteClose(wsCloseNormal, "evicted")
+			break LOOP
+		}
+
+		// paused clients asked for no frames, so nothing is counted
+		if paused {
+			frame.Release()
+			continue
+		}
+		if interval := sub.Interval(); interval > 0 && time.Since(lastSendTime) < interval {
+			frame.Release()
+			sub.drop()
+			session.skipped++
+			continue
+		}
+		if !takeFrame(len(frame.Data), bandwidth, pubSub.bandwidth, globalBandwidth) {
+			frame.Release()
+			sub.drop()
+			session.throttled++
+			continue
+		}
+
+		info, _ := json.Marshal(newFrameInfo(frame))
+		lastSendTime = time.Now()
+		err = ws.WriteMessage(wsText, info)
+		if err == nil {
+			err = ws.WriteMessage(wsBinary, frame.Data)
+		}
+		size := len(frame.Data)
+		frame.Release()
+		if err != nil {
+			session.reason = reasonWriteFailed
+			logServer.Debug("websocket write failed",
+				"source", pubSub.id, "client", sub.RemoteAddr, "error", err)
+			return
+		}
+		pubSub.output.Mark(size)
+		session.frames++
+
+		writeTime := time.Since(lastSendTime)
+		pubSub.writeTime.Add(writeTime)
+		if adaptiveRate {
+			interval := control.Update(writeTime)
+			sub.setInterval(interval, control.Latency())
+		}
+	}
+}
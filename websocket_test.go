@@ -0,0 +1,104 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+// clientFrame builds a masked client frame with a zero mask.
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+
+	frame := []byte{head}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}
+
+func TestReadFrameControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{"ping", clientFrame(true, wsPing, []byte("hello")), true},
+		{"max ping", clientFrame(true, wsPing, make([]byte, 125)), true},
+		{"long ping", clientFrame(true, wsPing, make([]byte, 126)), false},
+		{"fragmented ping", clientFrame(false, wsPing, nil), false},
+		{"fragmented close", clientFrame(false, wsClose, nil), false},
+		{"fragmented text", clientFrame(false, wsText, []byte("{")), true},
+	}
+
+	for _, test := range tests {
+		ws := &wsConn{br: bufio.NewReader(bytes.NewReader(test.frame))}
+		_, _, _, err := ws.readFrame()
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestCheckWebSocket(t *testing.T) {
+	saved := wsOrigins
+	defer func() { wsOrigins = saved }()
+	wsOrigins = nil
+
+	tests := []struct {
+		name    string
+		version string
+		origin  string
+		status  int
+	}{
+		{"same host", "13", "http://camera.example", 200},
+		{"no origin", "13", "", 200},
+		{"old version", "8", "", 400},
+		{"foreign origin", "13", "http://other.example", 403},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://camera.example/cam", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set("Sec-WebSocket-Version", test.version)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		status, _ := checkWebSocket(httptest.NewRecorder(), r)
+		if status != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, status, test.status)
+		}
+	}
+}